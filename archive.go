@@ -0,0 +1,292 @@
+package ParseTakeout
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// FileCount reports what was imported from one file of a Takeout archive
+type FileCount struct {
+	Archive  string `json:"archive"`
+	Path     string `json:"path"`
+	Parser   string `json:"parser"`
+	ImportID int64  `json:"importid"`
+	// Error is why the file could not be parsed, when it was rolled back
+	Error string `json:"error,omitempty"`
+	ImportSummary
+}
+
+func (c FileCount) String() string {
+	if c.Error != "" {
+		return fmt.Sprintf("%s: %s (%s) failed: %s", c.Archive, c.Path, c.Parser, c.Error)
+	}
+	return fmt.Sprintf("%s: %s (%s) import %d %v", c.Archive, c.Path, c.Parser, c.ImportID, c.ImportSummary)
+}
+
+// ImportArchive reads each Takeout .zip, .tgz/.tar.gz or .tar part without
+// extracting it and imports every file a parser is known for. Paths that are
+// not archives are imported as a single file. Records already in the database
+// are upserted, so overlapping Takeouts can be imported one after another.
+// Cached summaries the import made stale are then built again.
+//
+// Each file is its own import. A file that fails to parse is rolled back and
+// its error recorded in its FileCount, and the import carries on with the
+// next file. A database error stops the import, rolling back the file being
+// written, but files imported before it are kept.
+func ImportArchive(db *sql.DB, paths ...string) ([]FileCount, error) {
+	return ImportArchiveContext(context.Background(), db, paths...)
+}
+
+// ImportArchiveContext is ImportArchive, stopped when ctx is done. The file
+// being written then is rolled back, and the error wraps that of ctx.
+func ImportArchiveContext(ctx context.Context, db *sql.DB, paths ...string) ([]FileCount, error) {
+	w := NewWriterContext(ctx, db, 0)
+	counts, err := importArchives(w, paths)
+	if err != nil {
+		return counts, err
+	}
+	err = w.Close()
+	if err == nil {
+		err = refreshSummaries(ctx, db)
+	}
+	return counts, err
+}
+
+func importArchives(db *Writer, paths []string) ([]FileCount, error) {
+	counts := []FileCount{}
+	for _, p := range paths {
+		var err error
+		name := strings.ToLower(p)
+		switch {
+		case strings.HasSuffix(name, ".zip"):
+			counts, err = importZip(db, p, counts)
+		case strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar.gz"):
+			counts, err = importTar(db, p, true, counts)
+		case strings.HasSuffix(name, ".tar"):
+			counts, err = importTar(db, p, false, counts)
+		default:
+			counts, err = importFile(db, p, counts)
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+func importZip(db *Writer, archive string, counts []FileCount) ([]FileCount, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return counts, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return counts, err
+		}
+		count, ok, err := importEntry(db, archive, f.Name, r)
+		r.Close()
+		if err != nil {
+			return counts, fmt.Errorf("%s: %s: %w", archive, f.Name, err)
+		}
+		if ok {
+			counts = append(counts, count)
+		}
+	}
+	return counts, nil
+}
+
+func importTar(db *Writer, archive string, gzipped bool, counts []FileCount) ([]FileCount, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return counts, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return counts, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		count, ok, err := importEntry(db, archive, hdr.Name, tr)
+		if err != nil {
+			return counts, fmt.Errorf("%s: %s: %w", archive, hdr.Name, err)
+		}
+		if ok {
+			counts = append(counts, count)
+		}
+	}
+}
+
+func importFile(db *Writer, filePath string, counts []FileCount) ([]FileCount, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return counts, err
+	}
+	defer f.Close()
+
+	count, ok, err := importEntry(db, "", filePath, f)
+	if err != nil {
+		return counts, fmt.Errorf("%s: %w", filePath, err)
+	}
+	if ok {
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// dbSink upserts parsed records into the database, counting what happened to
+// each
+type dbSink struct {
+	db    *Writer
+	count *FileCount
+	// writeErr is the database error that stopped the parser, if one did
+	writeErr *error
+}
+
+// counted records the outcome of an upsert. Only invalid records are skipped;
+// a database error stops the import so its batch is rolled back.
+func (s dbSink) counted(o Outcome, err error) error {
+	if err != nil {
+		*s.writeErr = err
+		return err
+	}
+	s.count.Count(o)
+	return nil
+}
+
+func (s dbSink) AddItem(res Result) error {
+	if res.Validate() != nil {
+		s.count.Skipped++
+		return nil
+	}
+	return s.counted(s.db.UpsertItem(res))
+}
+
+func (s dbSink) AddLocation(loc Location) error {
+	return s.counted(s.db.UpsertLocation(loc))
+}
+
+func (s dbSink) AddPlaceVisit(visit PlaceVisit) error {
+	return s.counted(s.db.UpsertPlaceVisit(visit))
+}
+
+func (s dbSink) AddActivitySegment(segment ActivitySegment) error {
+	return s.counted(s.db.UpsertActivitySegment(segment))
+}
+
+// importEntry hands a file to the registered parser for its path inside the
+// archive, recording it as an import, and returns false when no parser
+// handles it. A file that fails to parse is rolled back and its error set in
+// the count. Any other error rolls back the file and is returned.
+func importEntry(db *Writer, archive, name string, r io.Reader) (FileCount, bool, error) {
+	count := FileCount{Archive: archive, Path: name}
+	p := ParserFor(name)
+	if p == nil {
+		return count, false, nil
+	}
+	count.Parser = p.Name()
+
+	id, err := db.BeginImport(archive, name, count.Parser)
+	if err == nil {
+		// Commit the import first so a failure can roll back every batch
+		// of it
+		err = db.Flush()
+	}
+	if err != nil {
+		db.Rollback()
+		return count, true, err
+	}
+	count.ImportID = id
+
+	// Hash the whole file even if the parser stops before the end
+	h := newHash()
+	tee := io.TeeReader(r, h)
+	var writeErr error
+	sink := dbSink{db: db, count: &count, writeErr: &writeErr}
+	if cp, ok := p.(ContextParser); ok {
+		err = cp.ParseContext(db.ctx, tee, sink)
+	} else {
+		err = p.Parse(tee, sink)
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, tee)
+	}
+	if err == nil {
+		err = db.FinishImport(sumHash(h), count.ImportSummary)
+		if err == nil {
+			err = db.Flush()
+		}
+		if err == nil {
+			return count, true, nil
+		}
+		writeErr = err
+	}
+
+	if writeErr == nil && db.ctx.Err() == nil {
+		// Parsers stop between records, so every record in the batch is whole
+		writeErr = db.Flush()
+		if writeErr == nil {
+			writeErr = RollbackImportContext(db.ctx, db.db, id)
+		}
+		if writeErr == nil {
+			count.ImportID = 0
+			count.Error = err.Error()
+			return count, true, nil
+		}
+		err = writeErr
+	}
+
+	// The batch may hold a half written record, so it is dropped before the
+	// batches flushed since the import began
+	db.Rollback()
+	if rbErr := dropImport(db.db, id); rbErr != nil {
+		return count, true, fmt.Errorf("%w, and rolling back import %d failed: %v", err, id, rbErr)
+	}
+	return count, true, err
+}
+
+// dropImport rolls back import id after a database error, even once the
+// context of the import is done
+func dropImport(db *sql.DB, id int64) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A BEGIN cancelled as it ran can leave its connection in a transaction
+	conn.ExecContext(ctx, `ROLLBACK;`)
+	return rollbackImport(ctx, conn, id)
+}
@@ -0,0 +1,311 @@
+package ParseTakeout
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var archiveFiles = map[string]string{
+	"Takeout/My Activity/Developers/MyActivity.html": testHome + "My-Activity-Developers.html",
+	"Takeout/My Activity/YouTube/MyActivity.json":    testHome + "My-Activity-Sample.json",
+	"Takeout/Drive/notes.txt":                        testHome + "My-Activity-Sample.json",
+}
+
+func writeTestZip(t *testing.T, archive string) {
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for name, src := range archiveFiles {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeZip writes an archive holding contents under each name
+func writeZip(t *testing.T, archive string, contents map[string]string) {
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for name, content := range contents {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTgz(t *testing.T, archive string) {
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, src := range archiveFiles {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "takeout-001.zip")
+	tgzPath := filepath.Join(dir, "takeout-002.tgz")
+	writeTestZip(t, zipPath)
+	writeTestTgz(t, tgzPath)
+
+	db, err := OpenDB(filepath.Join(dir, "takeout.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts, err := ImportArchive(db, zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache a summary for the second import to build again
+	if _, err := GetTotalSummary(db, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	more, err := ImportArchive(db, tgzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = append(counts, more...)
+	if len(counts) != 4 {
+		t.Fatalf("Expected 4 imported files, got %d", len(counts))
+	}
+
+	var total ImportSummary
+	for _, count := range counts {
+		total.Add(count.ImportSummary)
+	}
+	// The JSON repeats one HTML activity with different details and the second
+	// archive repeats the first
+	if total.New != 45 || total.New+total.Duplicate+total.Updated != 92 || total.Updated < 2 {
+		t.Fatalf("Expected 45 new items of 92, got %v", total)
+	}
+
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 45 {
+		t.Fatalf("Expected 45 items, got %d", len(results))
+	}
+
+	if stale, _ := staleSummaries(t, db); stale {
+		t.Error("Expected the import to build the cached summary again")
+	}
+	if sum := checkCachedSummary(t, db); sum.Total != 45 {
+		t.Errorf("Expected 45 items in the summary, got %d", sum.Total)
+	}
+}
+
+func TestImportArchiveDatabaseError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "takeout-001.zip")
+	writeTestZip(t, zipPath)
+
+	db, err := OpenDB(filepath.Join(dir, "takeout.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Fail after each item row is written, but before its products are
+	_, err = db.Exec(`
+	CREATE TRIGGER "fail_products" BEFORE INSERT ON "itemproducts" BEGIN
+		SELECT RAISE(ABORT, 'Disk full');
+	END;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ImportArchive(db, zipPath)
+	if err == nil || !strings.Contains(err.Error(), "Disk full") {
+		t.Fatalf("Expected the database error, got %v", err)
+	}
+	for _, table := range []string{"items", "imports"} {
+		if n := countRows(t, db, table); n != 0 {
+			t.Errorf("Expected the batch to be rolled back, found %d rows in %s", n, table)
+		}
+	}
+}
+
+func TestImportArchiveLocalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "takeout-001.zip")
+	writeZip(t, zipPath, map[string]string{
+		"Takeout/Meine Aktivitäten/Suche/MeineAktivitäten.html": activityHTML("de", "Suche",
+			`Gesucht nach&nbsp;<a href="https://www.google.com/search?q=wetter">wetter</a><br>06.01.2020, 23:07:12 MEZ`,
+			`<b>Produkte:</b><br>&emsp;Suche<br>`),
+		"Takeout/Mi actividad/YouTube/MiActividad.json": `[{"header": "YouTube", "title": "Has visto Un vídeo", "time": "2020-01-07T10:00:00.000Z", "products": ["YouTube"]}]`,
+	})
+
+	db, err := OpenDB(filepath.Join(dir, "takeout.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts, err := ImportArchive(db, zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Fatalf("Expected both localized files to be imported, got %v", counts)
+	}
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]string{}
+	for _, res := range results {
+		actions[res.Item] = res.Action
+	}
+	want := map[string]string{"wetter": "Searched for", "Un vídeo": "Watched"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("Expected items %v, got %v", want, actions)
+	}
+}
+
+func TestImportArchiveMalformedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The broken file writes an item before its error is found
+	badPath := filepath.Join(dir, "takeout-001.zip")
+	writeZip(t, badPath, map[string]string{
+		"Takeout/My Activity/YouTube/MyActivity.json": `[{"header": "YouTube", "title": "Watched Broken video", "time": "2020-01-07T10:00:00.000Z", "products": ["YouTube"]}, {"title": `,
+		"Takeout/My Activity/Search/MyActivity.json":  `[{"header": "Search", "title": "Searched for weather", "time": "2020-01-07T11:00:00.000Z", "products": ["Search"]}]`,
+	})
+	goodPath := filepath.Join(dir, "takeout-002.zip")
+	writeTestZip(t, goodPath)
+
+	db, err := OpenDB(filepath.Join(dir, "takeout.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts, err := ImportArchive(db, badPath, goodPath)
+	if err != nil {
+		t.Fatalf("Expected the import to carry on past the malformed file, got %v", err)
+	}
+	if len(counts) != 4 {
+		t.Fatalf("Expected 4 files, got %v", counts)
+	}
+	failed := 0
+	for _, count := range counts {
+		if count.Error == "" {
+			continue
+		}
+		failed++
+		if count.Path != "Takeout/My Activity/YouTube/MyActivity.json" || count.ImportID != 0 {
+			t.Errorf("Expected only the malformed file to fail, got %v", count)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected 1 file to fail, got %d", failed)
+	}
+
+	items, err := SearchItems(db, "Broken video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Expected the malformed file to be rolled back, got %v", items)
+	}
+	if n := countRows(t, db, "items"); n != 46 {
+		t.Errorf("Expected 46 items from the other files, got %d", n)
+	}
+	imports, err := ListImports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 3 {
+		t.Errorf("Expected 3 imports, got %d", len(imports))
+	}
+	for _, i := range imports {
+		if i.Finished == 0 {
+			t.Errorf("Expected every import to be finished, got %v", i)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/dylan-mitchell/ParseTakeout"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "Path to SQLITE3 DB")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: ImportArchive -db takeout.db takeout-001.zip [takeout-002.tgz ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(*dbPath) == 0 {
+		log.Fatal("Please specify a db file")
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatal("Please specify at least one Takeout archive to import")
+	}
+
+	db, err := ParseTakeout.OpenDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	counts, err := ParseTakeout.ImportArchive(db, flag.Args()...)
+	var total ParseTakeout.ImportSummary
+	for _, count := range counts {
+		fmt.Println(count)
+		total.Add(count.ImportSummary)
+	}
+	fmt.Println("Total:", total)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dylan-mitchell/ParseTakeout"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "Path to SQLITE3 DB")
+	flag.Parse()
+
+	if len(*dbPath) == 0 {
+		log.Fatal("Please specify a db file")
+	}
+
+	db, err := ParseTakeout.OpenDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	imports, err := ParseTakeout.ListImports(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, i := range imports {
+		fmt.Println(i, time.Unix(i.Started, 0).Format(time.RFC3339))
+	}
+}
@@ -4,43 +4,88 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/dylan-mitchell/ParseTakeout"
 )
 
 func main() {
 	html := flag.String("html", "", "Path to HTML from Google Takeout Data to parse")
+	jsonPath := flag.String("json", "", "Path to JSON My Activity from Google Takeout Data to parse")
 	dbPath := flag.String("db", "", "Path to SQLITE3 DB")
 	flag.Parse()
 
-	if len(*html) == 0 {
-		log.Fatal("Please specify a html file to parse")
+	if len(*html) == 0 && len(*jsonPath) == 0 {
+		log.Fatal("Please specify a html or json file to parse")
 	}
 
 	if len(*dbPath) == 0 {
 		log.Fatal("Please specify a db file")
 	}
 
-	results, err := ParseTakeout.ParseHTML(*html)
+	path, parser := *html, "My Activity HTML"
+	parse := ParseTakeout.ParseHTMLReader
+	if len(*html) == 0 {
+		path, parser = *jsonPath, "My Activity JSON"
+		parse = ParseTakeout.ParseActivityJSONReader
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer f.Close()
 
 	db, err := ParseTakeout.OpenDB(*dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	//Do something with the results
-	for _, result := range results {
+	//Stream the results into the db as they are parsed
+	w := ParseTakeout.NewWriter(db, 0)
+	id, err := w.BeginImport("", path, parser)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Commit the import first so a failure can roll back every batch of it
+	err = w.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var summary ParseTakeout.ImportSummary
+	err = parse(f, func(result ParseTakeout.Result) error {
 		err := result.Validate()
-		if err == nil {
-			err := ParseTakeout.InsertItem(db, result)
-			if err != nil {
-				fmt.Println(result)
-				fmt.Println(err)
-			}
+		if err != nil {
+			summary.Skipped++
+			return nil
 		}
-
+		o, err := w.UpsertItem(result)
+		if err != nil {
+			fmt.Println(result)
+			return err
+		}
+		summary.Count(o)
+		return nil
+	})
+	if err != nil {
+		// Drop the pending batch, then the batches already flushed, so a
+		// failed import leaves nothing behind
+		w.Rollback()
+		if err := ParseTakeout.RollbackImport(db, id); err != nil {
+			log.Println(err)
+		}
+		log.Fatal(err)
+	}
+	fileHash, err := ParseTakeout.HashFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = w.FinishImport(fileHash, summary)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
+	fmt.Println(summary)
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/dylan-mitchell/ParseTakeout"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "Path to SQLITE3 DB")
+	id := flag.Int64("id", 0, "ID of the import to roll back, as printed by ListImports")
+	flag.Parse()
+
+	if len(*dbPath) == 0 {
+		log.Fatal("Please specify a db file")
+	}
+
+	if *id == 0 {
+		log.Fatal("Please specify an import id")
+	}
+
+	db, err := ParseTakeout.OpenDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ParseTakeout.RollbackImport(db, *id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Rolled back import", *id)
+}
@@ -0,0 +1,143 @@
+package ParseTakeout
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countdownContext is cancelled after it has been checked n times, so a
+// test can stop an operation part way through
+type countdownContext struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int32
+}
+
+func newCountdownContext(n int32) *countdownContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &countdownContext{Context: ctx, cancel: cancel, n: n}
+}
+
+func (c *countdownContext) tick() {
+	if atomic.AddInt32(&c.n, -1) == 0 {
+		c.cancel()
+	}
+}
+
+func (c *countdownContext) Done() <-chan struct{} {
+	c.tick()
+	return c.Context.Done()
+}
+
+func (c *countdownContext) Err() error {
+	c.tick()
+	return c.Context.Err()
+}
+
+func TestParseHTMLContextCancel(t *testing.T) {
+	results, err := ParseHTML(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := os.Open(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	err = ParseHTMLReaderContext(ctx, f, func(res Result) error {
+		n++
+		if n == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n != 2 || n >= len(results) {
+		t.Fatalf("Expected parsing to stop after 2 of %d results, got %d", len(results), n)
+	}
+}
+
+func TestImportArchiveContextCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "takeout.zip")
+	writeTestZip(t, archive)
+	db, err := OpenDB(filepath.Join(dir, "cancel.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	done, err := ImportArchiveContext(newCountdownContext(50), db, archive)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The file being written was rolled back, import record included, and
+	// only the files finished before it are kept
+	imports, err := ListImports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != len(done) {
+		t.Fatalf("Expected %d imports, got %d", len(done), len(imports))
+	}
+	kept := 0
+	for i, imp := range imports {
+		if imp.ID != done[i].ImportID || imp.Finished == 0 {
+			t.Errorf("Expected finished import %d, got %v", done[i].ImportID, imp)
+		}
+		kept += done[i].New
+	}
+	if n := countRows(t, db, "items"); n != kept {
+		t.Fatalf("Expected %d items, got %d", kept, n)
+	}
+
+	counts, err := ImportArchive(db, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) == 0 {
+		t.Fatal("Expected the archive to import once not cancelled")
+	}
+}
+
+func TestGetTotalSummaryContextCancel(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	if _, err := GetTotalSummaryContext(context.Background(), db, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := GetTotalSummaryContext(newCountdownContext(20), db, time.UTC)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if sum != nil {
+		t.Fatalf("Expected no summary, got %v", sum)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := GetSummaryofYearContext(ctx, db, 1970, time.UTC); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ItemFilter selects items by every field that is set. Begin and End bound
+// "unixtime" to [Begin, End) and are ignored when zero.
+type ItemFilter struct {
+	Title   string
+	Action  string
+	Item    string
+	Product string
+	// Search matches items containing it literally, like SearchItems
+	Search string
+	Begin  int64
+	End    int64
+}
+
+// where builds the WHERE clause for the filter, empty when nothing is set
+func (f ItemFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+
+	if f.Title != "" {
+		add(`"title" = ?`, f.Title)
+	}
+	if f.Action != "" {
+		add(`"action" = ?`, f.Action)
+	}
+	if f.Item != "" {
+		add(`"item" = ?`, f.Item)
+	}
+	if f.Product != "" {
+		add(`("action", "unixtime", "item") IN (
+		SELECT "action", "unixtime", "item" FROM "itemproducts" WHERE "product" = ?
+	)`, f.Product)
+	}
+	if f.Search != "" {
+		add(`"item" LIKE ? ESCAPE '\'`, likePattern(f.Search))
+	}
+	if f.Begin != 0 {
+		add(`"unixtime" >= ?`, f.Begin)
+	}
+	if f.End != 0 {
+		add(`"unixtime" < ?`, f.End)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return `
+	WHERE ` + strings.Join(conds, " AND "), args
+}
+
+// DeleteItems deletes the items matching filter along with their products,
+// details and locations in one transaction, returning how many items were
+// removed. An empty filter is refused rather than deleting everything.
+func DeleteItems(db *sql.DB, filter ItemFilter) (int64, error) {
+	return DeleteItemsContext(context.Background(), db, filter)
+}
+
+// DeleteItemsContext is DeleteItems, stopped when ctx is done
+func DeleteItemsContext(ctx context.Context, db *sql.DB, filter ItemFilter) (int64, error) {
+	where, args := filter.where()
+	if where == "" {
+		return 0, errors.New("Empty filter")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := deleteItemsWhere(ctx, tx, where, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// deleteItemsWhere collects the matching keys first, as the filter may
+// depend on the child rows being deleted
+func deleteItemsWhere(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) (int64, error) {
+	err := execAll(tx, `
+	CREATE TEMP TABLE IF NOT EXISTS "deletekeys" (
+		"action"	TEXT,
+		"unixtime"	INTEGER,
+		"item"	TEXT
+	);
+	`, `
+	DELETE FROM "deletekeys";
+	`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO "deletekeys" SELECT "action", "unixtime", "item" FROM "items" `+where+`;
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, table := range itemDetailTables {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM "%s" WHERE ("action", "unixtime", "item") IN (
+			SELECT "action", "unixtime", "item" FROM "deletekeys"
+		);
+		`, table))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+	DELETE FROM "items" WHERE ("action", "unixtime", "item") IN (
+		SELECT "action", "unixtime", "item" FROM "deletekeys"
+	);
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PurgeRange deletes everything recorded in [begin, end): items, location
+// points, place visits and activity segments along with their child rows, in
+// one transaction. It returns how many items, points, visits and segments
+// were removed.
+func PurgeRange(db *sql.DB, begin, end int64) (int64, error) {
+	return PurgeRangeContext(context.Background(), db, begin, end)
+}
+
+// PurgeRangeContext is PurgeRange, stopped when ctx is done
+func PurgeRangeContext(ctx context.Context, db *sql.DB, begin, end int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := deleteItemsWhere(ctx, tx, `WHERE "unixtime" >= ? AND "unixtime" < ?`, begin, end)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// Child tables first, as they are keyed by their parent
+	stmts := []struct {
+		query  string
+		counts bool
+	}{
+		{`DELETE FROM "locationactivity" WHERE ("locationtime", "locationlatitude", "locationlongitude") IN (
+			SELECT "unixtime", "latitude", "longitude" FROM "locationhistory" WHERE "unixtime" >= ? AND "unixtime" < ?
+		);`, false},
+		{`DELETE FROM "locationhistory" WHERE "unixtime" >= ? AND "unixtime" < ?;`, true},
+		{`DELETE FROM "placevisits" WHERE "starttime" >= ? AND "starttime" < ?;`, true},
+		{`DELETE FROM "activitywaypoints" WHERE "starttime" >= ? AND "starttime" < ?;`, false},
+		{`DELETE FROM "activitysegments" WHERE "starttime" >= ? AND "starttime" < ?;`, true},
+	}
+	for _, stmt := range stmts {
+		res, err := tx.ExecContext(ctx, stmt.query, begin, end)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if !stmt.counts {
+			continue
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		removed += n
+	}
+
+	return removed, tx.Commit()
+}
@@ -0,0 +1,162 @@
+package ParseTakeout
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openDeleteTestDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(filepath.Join(dir, "delete.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	items := []Result{
+		{Title: "Search", Action: "Searched for", Item: "golang", Date: "d", UnixTime: 100, Products: []string{"Search"}},
+		{Title: "Search", Action: "Searched for", Item: "sqlite 100%", Date: "d", UnixTime: 200, Products: []string{"Search"}},
+		{Title: "YouTube", Action: "Watched", Item: "golang talk", Date: "d", UnixTime: 200, Products: []string{"YouTube"}},
+		{Title: "YouTube", Action: "Watched", Item: "cats", Date: "d", UnixTime: 300, Products: []string{"YouTube"}, Details: []string{"From Google Ads"}},
+	}
+	w := NewWriter(db, 0)
+	for _, res := range items {
+		if err := w.InsertItem(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locations := []Location{
+		{Unixtime: 200, Latitude: 1, Longitude: 1, Activities: []LocationActivity{{Unixtime: 199, Type: "STILL", Confidence: 90}}},
+		{Unixtime: 200, Latitude: 2, Longitude: 2},
+		{Unixtime: 300, Latitude: 3, Longitude: 3},
+	}
+	for _, loc := range locations {
+		if err := w.InsertLocation(loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.InsertPlaceVisit(PlaceVisit{StartTime: 150, EndTime: 250, Name: "Home"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.InsertActivitySegment(ActivitySegment{StartTime: 250, EndTime: 300, Waypoints: []Waypoint{{1, 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM "` + table + `";`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDeleteItemByKey(t *testing.T) {
+	db, done := openDeleteTestDB(t)
+	defer done()
+
+	// Only the item with the full key goes, not everything at its time
+	err := DeleteItem(db, Result{Action: "Watched", Item: "golang talk", UnixTime: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 items left, got %d", len(results))
+	}
+	if countRows(t, db, "itemproducts") != 3 {
+		t.Fatal("Expected the deleted item's product to go with it")
+	}
+
+	err = DeleteLocation(db, Location{Unixtime: 200, Latitude: 2, Longitude: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countRows(t, db, "locationhistory") != 2 || countRows(t, db, "locationactivity") != 1 {
+		t.Fatal("Expected only the point at 2,2 to be deleted")
+	}
+	err = DeleteLocation(db, Location{Unixtime: 200, Latitude: 1, Longitude: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countRows(t, db, "locationactivity") != 0 {
+		t.Fatal("Expected the last point's activity to be deleted")
+	}
+}
+
+func TestDeleteItems(t *testing.T) {
+	db, done := openDeleteTestDB(t)
+	defer done()
+
+	_, err := DeleteItems(db, ItemFilter{})
+	if err == nil {
+		t.Fatal("Expected an empty filter to be refused")
+	}
+
+	tests := []struct {
+		filter  ItemFilter
+		removed int64
+		left    int
+	}{
+		{ItemFilter{Search: "100%"}, 1, 3},
+		{ItemFilter{Search: "golang", Product: "Search"}, 1, 2},
+		{ItemFilter{Title: "YouTube", Begin: 250}, 1, 1},
+		{ItemFilter{Action: "Watched", End: 250}, 1, 0},
+	}
+	for _, test := range tests {
+		removed, err := DeleteItems(db, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != test.removed {
+			t.Fatalf("%+v: expected %d removed, got %d", test.filter, test.removed, removed)
+		}
+		if n := countRows(t, db, "items"); n != test.left {
+			t.Fatalf("%+v: expected %d left, got %d", test.filter, test.left, n)
+		}
+	}
+	if countRows(t, db, "itemproducts") != 0 || countRows(t, db, "itemdetails") != 0 {
+		t.Fatal("Expected no orphaned child rows")
+	}
+}
+
+func TestPurgeRange(t *testing.T) {
+	db, done := openDeleteTestDB(t)
+	defer done()
+
+	removed, err := PurgeRange(db, 150, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 items, 2 points, 1 visit and 1 segment
+	if removed != 6 {
+		t.Fatalf("Expected 6 removed, got %d", removed)
+	}
+	if countRows(t, db, "items") != 2 || countRows(t, db, "itemproducts") != 2 || countRows(t, db, "itemdetails") != 1 {
+		t.Fatal("Expected the items outside the range to be kept")
+	}
+	if countRows(t, db, "locationhistory") != 1 || countRows(t, db, "locationactivity") != 0 {
+		t.Fatal("Expected only the point at 300 to be kept")
+	}
+	if countRows(t, db, "placevisits") != 0 || countRows(t, db, "activitysegments") != 0 || countRows(t, db, "activitywaypoints") != 0 {
+		t.Fatal("Expected the semantic history in range to be purged")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/dylan-mitchell/ParseTakeout
 
-go 1.13
+go 1.14
 
 require (
 	github.com/araddon/dateparse v0.0.0-20190622164848-0fb0a474d195
@@ -0,0 +1,395 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Import records where a batch of rows came from. Rows written by an import
+// carry its ID in their "importid" column.
+type Import struct {
+	ID       int64  `json:"id"`
+	Archive  string `json:"archive"`
+	Path     string `json:"path"`
+	FileHash string `json:"filehash"`
+	Parser   string `json:"parser"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+	ImportSummary
+}
+
+func (i Import) String() string {
+	return fmt.Sprintf("%d: %s %s (%s) %v", i.ID, i.Archive, i.Path, i.Parser, i.ImportSummary)
+}
+
+// HashFile returns the SHA-256 of the file at filePath, as stored for imports
+func HashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return sumHash(h), nil
+}
+
+// BeginImport records the start of an import of path, from archive if it came
+// from one. Rows the writer adds until FinishImport belong to it.
+func (w *Writer) BeginImport(archive, path, parser string) (int64, error) {
+	res, err := w.Exec(`
+	INSERT INTO "imports" ("archive", "path", "parser", "started")
+	VALUES (?, ?, ?, ?);
+	`, archive, path, parser, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	w.importID = sql.NullInt64{Int64: id, Valid: true}
+	return id, nil
+}
+
+// FinishImport records the hash of the imported file and what importing it did
+func (w *Writer) FinishImport(fileHash string, summary ImportSummary) error {
+	if !w.importID.Valid {
+		return nil
+	}
+	_, err := w.Exec(`
+	UPDATE "imports" SET "filehash" = ?, "finished" = ?, "new" = ?, "duplicate" = ?, "updated" = ?, "skipped" = ?
+	WHERE "id" = ?;
+	`, fileHash, time.Now().Unix(), summary.New, summary.Duplicate, summary.Updated, summary.Skipped, w.importID)
+	w.importID = sql.NullInt64{}
+	return err
+}
+
+// Kinds of record an import can replace
+const (
+	kindItem            = "item"
+	kindLocation        = "location"
+	kindPlaceVisit      = "placevisit"
+	kindActivitySegment = "activitysegment"
+)
+
+// recordKeys are the table of each kind of record and the clause selecting
+// one by its unique key
+var recordKeys = map[string]struct{ table, where string }{
+	kindItem:            {"items", `WHERE "action" = ? AND "unixtime" = ? AND "item" = ?`},
+	kindLocation:        {"locationhistory", `WHERE "unixtime" = ? AND "latitude" = ? AND "longitude" = ?`},
+	kindPlaceVisit:      {"placevisits", `WHERE "starttime" = ?`},
+	kindActivitySegment: {"activitysegments", `WHERE "starttime" = ?`},
+}
+
+// loadRecord reads the record of kind stored under key, with its child rows
+func loadRecord(ctx context.Context, db queryer, kind string, key []interface{}) (interface{}, error) {
+	where := recordKeys[kind].where
+	var records []interface{}
+	switch kind {
+	case kindItem:
+		results, err := queryItems(ctx, db, where, key...)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range results {
+			records = append(records, res)
+		}
+	case kindLocation:
+		locations, err := queryLocations(ctx, db, where, key...)
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range locations {
+			records = append(records, loc)
+		}
+	case kindPlaceVisit:
+		visits, err := queryPlaceVisits(ctx, db, where, key...)
+		if err != nil {
+			return nil, err
+		}
+		for _, visit := range visits {
+			records = append(records, visit)
+		}
+	case kindActivitySegment:
+		segments, err := queryActivitySegments(ctx, db, where, key...)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range segments {
+			records = append(records, segment)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown record kind %q", kind)
+	}
+	if len(records) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return records[0], nil
+}
+
+// saveReplaced keeps the record of kind stored under key before the current
+// import updates it, along with the import it belonged to. Records the import
+// wrote itself, and updates outside an import, are not kept.
+func (w *Writer) saveReplaced(kind string, key ...interface{}) error {
+	if !w.importID.Valid {
+		return nil
+	}
+	k := recordKeys[kind]
+	var owner sql.NullInt64
+	err := w.scan(`SELECT "importid" FROM "`+k.table+`" `+k.where+`;`, key, &owner)
+	if err != nil {
+		return err
+	}
+	if owner == w.importID {
+		return nil
+	}
+
+	record, err := loadRecord(w.ctx, w, kind, key)
+	if err != nil {
+		return err
+	}
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Exec(`
+	INSERT INTO "replacedrecords" ("importid", "kind", "key", "previousimportid", "record")
+	VALUES (?, ?, ?, ?, ?);
+	`, w.importID, kind, string(encodedKey), owner, string(encodedRecord))
+	return err
+}
+
+// restoreRecord inserts a record kept by saveReplaced as it was, unless a
+// later import has replaced it since, in which case that import keeps it
+func restoreRecord(ctx context.Context, tx *sql.Tx, kind, record string, importID sql.NullInt64) error {
+	var key []interface{}
+	var insert func() error
+	switch kind {
+	case kindItem:
+		var res Result
+		if err := json.Unmarshal([]byte(record), &res); err != nil {
+			return err
+		}
+		key = []interface{}{res.Action, res.UnixTime, res.Item}
+		insert = func() error { return insertItem(ctx, tx, res, importID) }
+	case kindLocation:
+		var loc Location
+		if err := json.Unmarshal([]byte(record), &loc); err != nil {
+			return err
+		}
+		key = []interface{}{loc.Unixtime, loc.Latitude, loc.Longitude}
+		insert = func() error { return insertLocation(ctx, tx, loc, importID) }
+	case kindPlaceVisit:
+		var visit PlaceVisit
+		if err := json.Unmarshal([]byte(record), &visit); err != nil {
+			return err
+		}
+		key = []interface{}{visit.StartTime}
+		insert = func() error { return insertPlaceVisit(ctx, tx, visit, importID) }
+	case kindActivitySegment:
+		var segment ActivitySegment
+		if err := json.Unmarshal([]byte(record), &segment); err != nil {
+			return err
+		}
+		key = []interface{}{segment.StartTime}
+		insert = func() error { return insertActivitySegment(ctx, tx, segment, importID) }
+	default:
+		return fmt.Errorf("Unknown record kind %q", kind)
+	}
+
+	k := recordKeys[kind]
+	var stored int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM "`+k.table+`" `+k.where+`;`, key...).Scan(&stored)
+	if err != nil || stored > 0 {
+		return err
+	}
+	return insert()
+}
+
+func ListImports(db *sql.DB) ([]Import, error) {
+	return ListImportsContext(context.Background(), db)
+}
+
+// ListImportsContext is ListImports, stopped when ctx is done
+func ListImportsContext(ctx context.Context, db *sql.DB) ([]Import, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "id", "archive", "path", "filehash", "parser", "started", "finished", "new", "duplicate", "updated", "skipped"
+	FROM "imports"
+	ORDER BY "id" ASC;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	imports := []Import{}
+	for rows.Next() {
+		var i Import
+		var fileHash sql.NullString
+		var finished sql.NullInt64
+		if err := rows.Scan(&i.ID, &i.Archive, &i.Path, &fileHash, &i.Parser, &i.Started, &finished, &i.New, &i.Duplicate, &i.Updated, &i.Skipped); err != nil {
+			return nil, err
+		}
+		i.FileHash = fileHash.String
+		i.Finished = finished.Int64
+		imports = append(imports, i)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return imports, nil
+}
+
+// RollbackImport deletes every row import id wrote, along with their
+// products, details, locations, activities and waypoints, and then the import
+// itself. Rows the import updated are restored to what was stored before,
+// unless a later import has updated them again.
+func RollbackImport(db *sql.DB, id int64) error {
+	return RollbackImportContext(context.Background(), db, id)
+}
+
+// RollbackImportContext is RollbackImport, stopped when ctx is done
+func RollbackImportContext(ctx context.Context, db *sql.DB, id int64) error {
+	return rollbackImport(ctx, db, id)
+}
+
+func rollbackImport(ctx context.Context, db beginner, id int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var found int64
+	err = tx.QueryRowContext(ctx, `SELECT "id" FROM "imports" WHERE "id" = ?;`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return fmt.Errorf("No import with ID %d", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	replaced, err := loadReplaced(ctx, tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Records later imports replaced from this one go back to what this one
+	// replaced, or are dropped if it wrote them first
+	_, err = tx.ExecContext(ctx, `
+	UPDATE "replacedrecords" SET ("record", "previousimportid") = (
+		SELECT y."record", y."previousimportid" FROM "replacedrecords" AS y
+		WHERE y."importid" = ?1 AND y."kind" = "replacedrecords"."kind" AND y."key" = "replacedrecords"."key"
+	)
+	WHERE "previousimportid" = ?1 AND EXISTS (
+		SELECT 1 FROM "replacedrecords" AS y
+		WHERE y."importid" = ?1 AND y."kind" = "replacedrecords"."kind" AND y."key" = "replacedrecords"."key"
+	);
+	`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stmts := []string{`
+	DELETE FROM "replacedrecords" WHERE "previousimportid" = ?;
+	`}
+	for _, table := range itemDetailTables {
+		stmts = append(stmts, fmt.Sprintf(`
+		DELETE FROM "%s" WHERE ("action", "unixtime", "item") IN (
+			SELECT "action", "unixtime", "item" FROM "items" WHERE "importid" = ?
+		);
+		`, table))
+	}
+	stmts = append(stmts, `
+	DELETE FROM "items" WHERE "importid" = ?;
+	`, `
+	DELETE FROM "locationactivity" WHERE ("locationtime", "locationlatitude", "locationlongitude") IN (
+		SELECT "unixtime", "latitude", "longitude" FROM "locationhistory" WHERE "importid" = ?
+	);
+	`, `
+	DELETE FROM "locationhistory" WHERE "importid" = ?;
+	`, `
+	DELETE FROM "activitywaypoints" WHERE "starttime" IN (
+		SELECT "starttime" FROM "activitysegments" WHERE "importid" = ?
+	);
+	`, `
+	DELETE FROM "activitysegments" WHERE "importid" = ?;
+	`, `
+	DELETE FROM "placevisits" WHERE "importid" = ?;
+	`, `
+	DELETE FROM "imports" WHERE "id" = ?;
+	`)
+
+	for _, stmt := range stmts {
+		_, err := tx.ExecContext(ctx, stmt, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, r := range replaced {
+		err := restoreRecord(ctx, tx, r.kind, r.record, r.previousImportID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM "replacedrecords" WHERE "importid" = ?;`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// replacedRecord is a record kept by saveReplaced
+type replacedRecord struct {
+	kind             string
+	record           string
+	previousImportID sql.NullInt64
+}
+
+// loadReplaced reads the records import id replaced
+func loadReplaced(ctx context.Context, tx *sql.Tx, id int64) ([]replacedRecord, error) {
+	rows, err := tx.QueryContext(ctx, `
+	SELECT "kind", "record", "previousimportid" FROM "replacedrecords"
+	WHERE "importid" = ?;
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replaced []replacedRecord
+	for rows.Next() {
+		var r replacedRecord
+		if err := rows.Scan(&r.kind, &r.record, &r.previousImportID); err != nil {
+			return nil, err
+		}
+		replaced = append(replaced, r)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
@@ -0,0 +1,268 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRollbackImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "imports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	zipPath := filepath.Join(dir, "takeout-001.zip")
+	writeTestZip(t, zipPath)
+	_, err = ImportArchive(db, zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(testHome + "Location-History-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locationPath := filepath.Join(dir, "Location History.json")
+	err = ioutil.WriteFile(locationPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := ImportArchive(db, locationPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[0].New != 3 {
+		t.Fatalf("Expected 3 new locations, got %v", counts)
+	}
+
+	imports, err := ListImports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 3 {
+		t.Fatalf("Expected 3 imports, got %v", imports)
+	}
+	locationImport := imports[2]
+	hash, err := HashFile(locationPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locationImport.ID != counts[0].ImportID || locationImport.Archive != "" || locationImport.Parser != "Location History" || locationImport.FileHash != hash || locationImport.New != 3 || locationImport.Finished == 0 {
+		t.Fatalf("Unexpected import %+v", locationImport)
+	}
+	for _, i := range imports[:2] {
+		if i.Archive != zipPath || i.FileHash == "" {
+			t.Fatalf("Expected an import from %s, got %+v", zipPath, i)
+		}
+	}
+
+	err = RollbackImport(db, locationImport.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 0 {
+		t.Fatalf("Expected no locations after rollback, got %d", len(locations))
+	}
+	var activities int
+	err = db.QueryRow(`SELECT COUNT(*) FROM "locationactivity";`).Scan(&activities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activities != 0 {
+		t.Fatalf("Expected no activities after rollback, got %d", activities)
+	}
+
+	before, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var htmlImport Import
+	for _, i := range imports {
+		if i.Parser == "My Activity HTML" {
+			htmlImport = i
+		}
+	}
+	// Whichever of the HTML and JSON came second in the zip owns the item they
+	// share
+	var owned int
+	err = db.QueryRow(`SELECT COUNT(*) FROM "items" WHERE "importid" = ?;`, htmlImport.ID).Scan(&owned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owned != 42 && owned != 43 {
+		t.Fatalf("Expected the HTML import to own 42 or 43 items, got %d", owned)
+	}
+	// If it came second, rolling it back restores the shared item from the JSON
+	var replaced int
+	err = db.QueryRow(`SELECT COUNT(*) FROM "replacedrecords" WHERE "importid" = ?;`, htmlImport.ID).Scan(&replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != owned-42 {
+		t.Fatalf("Expected the HTML import to replace %d items, got %d", owned-42, replaced)
+	}
+	err = RollbackImport(db, htmlImport.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before)-len(after) != 42 {
+		t.Fatalf("Expected 42 items removed, got %d", len(before)-len(after))
+	}
+	var orphans int
+	err = db.QueryRow(`
+	SELECT COUNT(*) FROM "itemproducts" WHERE ("action", "unixtime", "item") NOT IN (
+		SELECT "action", "unixtime", "item" FROM "items"
+	);
+	`).Scan(&orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Fatalf("Expected no orphaned products, got %d", orphans)
+	}
+
+	imports, err = ListImports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 1 {
+		t.Fatalf("Expected 1 import left, got %v", imports)
+	}
+
+	err = RollbackImport(db, locationImport.ID)
+	if err == nil {
+		t.Fatal("Expected an error rolling back a missing import")
+	}
+}
+
+// upsertImport upserts records as a new import, returning its ID
+func upsertImport(t *testing.T, db *sql.DB, records ...interface{}) int64 {
+	t.Helper()
+	w := NewWriter(db, 0)
+	id, err := w.BeginImport("", "test.json", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		switch r := record.(type) {
+		case Result:
+			_, err = w.UpsertItem(r)
+		case Location:
+			_, err = w.UpsertLocation(r)
+		case PlaceVisit:
+			_, err = w.UpsertPlaceVisit(r)
+		case ActivitySegment:
+			_, err = w.UpsertActivitySegment(r)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.FinishImport("", ImportSummary{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// checkRecord compares the record of kind stored under key, and the import
+// owning it, with want and owner
+func checkRecord(t *testing.T, db *sql.DB, kind string, key []interface{}, want interface{}, owner sql.NullInt64) {
+	t.Helper()
+	got, err := loadRecord(context.Background(), db, kind, key)
+	if err != nil {
+		t.Fatalf("Loading %s %v: %v", kind, key, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %s %+v, got %+v", kind, want, got)
+	}
+	var stored sql.NullInt64
+	k := recordKeys[kind]
+	err = db.QueryRow(`SELECT "importid" FROM "`+k.table+`" `+k.where+`;`, key...).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != owner {
+		t.Errorf("Expected %s %v to belong to import %v, got %v", kind, key, owner, stored)
+	}
+}
+
+func TestRollbackImportRestoresReplaced(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	cats := Result{Title: "YouTube", Action: "Watched", Item: "cats", Date: "d", UnixTime: 300, Products: []string{"YouTube"}, Details: []string{"From Google Ads"}}
+	item := Result{Title: "Search", Action: "Searched for", Item: "new", Date: "a", UnixTime: 400, Products: []string{"Search"}, Details: []string{"a"}}
+	loc := Location{Unixtime: 400, Latitude: 4, Longitude: 4, Accuracy: 10, Activities: []LocationActivity{{Unixtime: 399, Type: "WALKING", Confidence: 50}}}
+	visit := PlaceVisit{StartTime: 400, EndTime: 500, Name: "Home"}
+	segment := ActivitySegment{StartTime: 500, EndTime: 600, ActivityType: "WALKING", Waypoints: []Waypoint{{1, 1}}}
+	a := upsertImport(t, db, item, loc, visit, segment)
+
+	catsB, itemB, locB, visitB, segmentB := cats, item, loc, visit, segment
+	catsB.Details = nil
+	itemB.Date, itemB.Details = "b", []string{"b"}
+	locB.Accuracy, locB.Activities = 20, nil
+	visitB.Name = "Work"
+	segmentB.Waypoints = []Waypoint{{2, 2}, {3, 3}}
+	b := upsertImport(t, db, catsB, itemB, locB, visitB, segmentB)
+
+	itemC := item
+	itemC.Date, itemC.Details = "c", nil
+	c := upsertImport(t, db, itemC)
+
+	owner := func(id int64) sql.NullInt64 { return sql.NullInt64{Int64: id, Valid: true} }
+	itemKey := []interface{}{item.Action, item.UnixTime, item.Item}
+	checkRecord(t, db, kindItem, itemKey, itemC, owner(c))
+
+	// Rolling back B restores what it replaced, except the item C replaced
+	// since
+	if err := RollbackImport(db, b); err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, db, kindItem, []interface{}{cats.Action, cats.UnixTime, cats.Item}, cats, sql.NullInt64{})
+	checkRecord(t, db, kindItem, itemKey, itemC, owner(c))
+	checkRecord(t, db, kindLocation, []interface{}{loc.Unixtime, loc.Latitude, loc.Longitude}, loc, owner(a))
+	checkRecord(t, db, kindPlaceVisit, []interface{}{visit.StartTime}, visit, owner(a))
+	checkRecord(t, db, kindActivitySegment, []interface{}{segment.StartTime}, segment, owner(a))
+
+	// Rolling back C then goes back past B to A
+	if err := RollbackImport(db, c); err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, db, kindItem, itemKey, item, owner(a))
+
+	if err := RollbackImport(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRecord(context.Background(), db, kindItem, itemKey); err != sql.ErrNoRows {
+		t.Errorf("Expected the item to be deleted, got %v", err)
+	}
+	var kept int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "replacedrecords";`).Scan(&kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept != 0 {
+		t.Errorf("Expected no replaced records left, got %d", kept)
+	}
+}
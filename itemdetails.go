@@ -0,0 +1,189 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Products, details and locations from an item's caption are stored in child
+// tables keyed by the same ("action", "unixtime", "item") as "items"
+type itemKey struct {
+	action   string
+	unixtime int64
+	item     string
+}
+
+func (r Result) key() itemKey {
+	return itemKey{
+		action:   r.Action,
+		unixtime: r.UnixTime,
+		item:     r.Item,
+	}
+}
+
+func insertItemDetails(ctx context.Context, db execer, res Result) error {
+	for _, product := range res.Products {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO "itemproducts" ("action", "unixtime", "item", "product")
+		VALUES (?, ?, ?, ?);
+		`, res.Action, res.UnixTime, res.Item, product)
+		if err != nil {
+			return err
+		}
+	}
+	for _, detail := range res.Details {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO "itemdetails" ("action", "unixtime", "item", "detail")
+		VALUES (?, ?, ?, ?);
+		`, res.Action, res.UnixTime, res.Item, detail)
+		if err != nil {
+			return err
+		}
+	}
+	for _, loc := range res.Locations {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO "itemlocations" ("action", "unixtime", "item", "name", "url", "latitude", "longitude")
+		VALUES (?, ?, ?, ?, ?, ?, ?);
+		`, res.Action, res.UnixTime, res.Item, loc.Name, loc.URL, loc.Latitude, loc.Longitude)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detailBatch is how many items attachItemDetails looks up at once, keeping
+// their keys under SQLite's limit of 999 parameters
+const detailBatch = 300
+
+// attachItemDetails fills in the child rows of results by their keys
+func attachItemDetails(ctx context.Context, db queryer, results []Result) error {
+	for len(results) > 0 {
+		n := len(results)
+		if n > detailBatch {
+			n = detailBatch
+		}
+		if err := attachDetailBatch(ctx, db, results[:n]); err != nil {
+			return err
+		}
+		results = results[n:]
+	}
+	return nil
+}
+
+func attachDetailBatch(ctx context.Context, db queryer, results []Result) error {
+	index := make(map[itemKey]int, len(results))
+	keys := make([]string, len(results))
+	args := make([]interface{}, 0, 3*len(results))
+	for i, res := range results {
+		index[res.key()] = i
+		keys[i] = "(?, ?, ?)"
+		args = append(args, res.Action, res.UnixTime, res.Item)
+	}
+
+	matching := `("action", "unixtime", "item") IN (VALUES ` + strings.Join(keys, ", ") + `)`
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT "action", "unixtime", "item", "product" FROM "itemproducts"
+	WHERE `+matching+`;
+	`, args...)
+	if err != nil {
+		return err
+	}
+	err = scanItemDetails(rows, index, func(i int, value string) {
+		results[i].Products = append(results[i].Products, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+	SELECT "action", "unixtime", "item", "detail" FROM "itemdetails"
+	WHERE `+matching+`;
+	`, args...)
+	if err != nil {
+		return err
+	}
+	err = scanItemDetails(rows, index, func(i int, value string) {
+		results[i].Details = append(results[i].Details, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+	SELECT "action", "unixtime", "item", "name", "url", "latitude", "longitude" FROM "itemlocations"
+	WHERE `+matching+`;
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var action, item, name, link string
+		var unixtime int64
+		var lat, lon float64
+		if err := rows.Scan(&action, &unixtime, &item, &name, &link, &lat, &lon); err != nil {
+			return err
+		}
+		i, ok := index[itemKey{action: action, unixtime: unixtime, item: item}]
+		if !ok {
+			continue
+		}
+		results[i].Locations = append(results[i].Locations, ActivityLocation{
+			Name:      name,
+			URL:       link,
+			Latitude:  lat,
+			Longitude: lon,
+		})
+	}
+	// Check for errors from iterating over rows.
+	return rows.Err()
+}
+
+func scanItemDetails(rows *sql.Rows, index map[itemKey]int, add func(int, string)) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var action, item, value string
+		var unixtime int64
+		if err := rows.Scan(&action, &unixtime, &item, &value); err != nil {
+			return err
+		}
+		i, ok := index[itemKey{action: action, unixtime: unixtime, item: item}]
+		if !ok {
+			continue
+		}
+		add(i, value)
+	}
+	// Check for errors from iterating over rows.
+	return rows.Err()
+}
+
+func GetItemsByProduct(db *sql.DB, product string) ([]Result, error) {
+	return GetItemsByProductContext(context.Background(), db, product)
+}
+
+// GetItemsByProductContext is GetItemsByProduct, stopped when ctx is done
+func GetItemsByProductContext(ctx context.Context, db *sql.DB, product string) ([]Result, error) {
+	return GetItemsContext(ctx, db, Query{Products: []string{product}})
+}
+
+// GetItemsInArea returns the items with a caption location inside the given
+// latitude/longitude bounding box
+func GetItemsInArea(db *sql.DB, minLat, minLon, maxLat, maxLon float64) ([]Result, error) {
+	return GetItemsInAreaContext(context.Background(), db, minLat, minLon, maxLat, maxLon)
+}
+
+// GetItemsInAreaContext is GetItemsInArea, stopped when ctx is done
+func GetItemsInAreaContext(ctx context.Context, db *sql.DB, minLat, minLon, maxLat, maxLon float64) ([]Result, error) {
+	return queryItems(ctx, db, `
+	WHERE ("action", "unixtime", "item") IN (
+		SELECT "action", "unixtime", "item" FROM "itemlocations"
+		WHERE NOT ("latitude" = 0 AND "longitude" = 0) AND "latitude" BETWEEN ? AND ? AND "longitude" BETWEEN ? AND ?
+	) ORDER BY "unixtime" ASC`, minLat, maxLat, minLon, maxLon)
+}
@@ -0,0 +1,380 @@
+package ParseTakeout
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Locale describes the language a My Activity export was made in. Localized
+// phrases are mapped back to the English ones so every export lands in the
+// database the same way.
+type Locale struct {
+	Name string
+	// Actions maps a localized action phrase to the canonical English action
+	Actions map[string]string
+	// Months maps lower case localized month names and abbreviations to English
+	Months map[string]string
+	// Sections maps localized caption headers to Products, Locations or Details
+	Sections map[string]string
+	// DateLayouts are tried before falling back to dateparse
+	DateLayouts []string
+	// Zones are checked before the default abbreviations
+	Zones map[string]*time.Location
+	// ActivityFolder is what the My Activity folder of an export is called,
+	// e.g. "Meine Aktivitäten"
+	ActivityFolder string
+}
+
+var locales = map[string]*Locale{}
+var localeNames []string
+
+// localeKey is the name a locale is registered and looked up under, so
+// "pt_BR" and "pt-br" are the same
+func localeKey(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+// RegisterLocale adds l to the locales used for detection, replacing any
+// locale already registered with the same name, ignoring case
+func RegisterLocale(l *Locale) {
+	name := localeKey(l.Name)
+	if _, ok := locales[name]; !ok {
+		localeNames = append(localeNames, name)
+	}
+	locales[name] = l
+}
+
+// GetLocale looks up a registered locale by name, accepting region tagged
+// names like "de-DE"
+func GetLocale(name string) (*Locale, bool) {
+	name = localeKey(name)
+	l, ok := locales[name]
+	if ok {
+		return l, true
+	}
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return nil, false
+	}
+	l, ok = locales[name[:i]]
+	return l, ok
+}
+
+// English is the default locale
+func English() *Locale {
+	l, _ := GetLocale("en")
+	return l
+}
+
+// detectLocale returns the first registered locale that recognises the
+// action in line
+func detectLocale(line []segment) *Locale {
+	for _, name := range localeNames {
+		var res Result
+		res.parseActivity(line, locales[name])
+		if res.Action != "" {
+			return locales[name]
+		}
+	}
+	return nil
+}
+
+// phrases returns the action phrases longest first so "Watched a video in"
+// wins over "Watched"
+func (l *Locale) phrases() []string {
+	phrases := make([]string, 0, len(l.Actions))
+	for phrase := range l.Actions {
+		phrases = append(phrases, phrase)
+	}
+	sort.Slice(phrases, func(i, j int) bool {
+		if len(phrases[i]) != len(phrases[j]) {
+			return len(phrases[i]) > len(phrases[j])
+		}
+		return phrases[i] < phrases[j]
+	})
+	return phrases
+}
+
+// matchPrefix matches text starting with an action phrase, returning the
+// canonical action and whatever follows it
+func (l *Locale) matchPrefix(text string) (string, string, bool) {
+	for _, phrase := range l.phrases() {
+		if text == phrase {
+			return l.Actions[phrase], "", true
+		}
+		if strings.HasPrefix(text, phrase) {
+			rest := text[len(phrase):]
+			r := []rune(rest)
+			if unicode.IsSpace(r[0]) || r[0] == ':' {
+				return l.Actions[phrase], strings.TrimSpace(strings.TrimPrefix(rest, ":")), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// matchSuffix matches text ending with an action phrase, as in languages that
+// put the verb after the item
+func (l *Locale) matchSuffix(text string) (string, string, bool) {
+	for _, phrase := range l.phrases() {
+		if strings.HasSuffix(text, phrase) {
+			return l.Actions[phrase], strings.TrimSpace(strings.TrimSuffix(text, phrase)), true
+		}
+	}
+	return "", "", false
+}
+
+func (l *Locale) section(header string) string {
+	header = strings.TrimSpace(header)
+	header = strings.TrimSuffix(strings.TrimSuffix(header, ":"), "：")
+	if l != nil {
+		if section, ok := l.Sections[header]; ok {
+			return section
+		}
+	}
+	return header
+}
+
+func (l *Locale) zone(abbreviation string) (*time.Location, bool) {
+	if l != nil {
+		if zone, ok := l.Zones[abbreviation]; ok {
+			return zone, true
+		}
+	}
+	zone, ok := zoneAbbreviations[abbreviation]
+	return zone, ok
+}
+
+// inActivityFolder reports whether name is in the My Activity folder of l, or
+// is a file named after it like "MyActivity.html" or "My-Activity.json"
+func (l *Locale) inActivityFolder(name string) bool {
+	folder := l.ActivityFolder
+	if folder == "" {
+		return false
+	}
+	if strings.Contains(name, folder+"/") {
+		return true
+	}
+	base := path.Base(name)
+	for _, prefix := range []string{folder, strings.Replace(folder, " ", "", -1), strings.Replace(folder, " ", "-", -1)} {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateMonths swaps localized month names in a date for English ones
+func (l *Locale) translateMonths(s string) string {
+	if l == nil || len(l.Months) == 0 {
+		return s
+	}
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		word := strings.TrimRight(field, ".,")
+		month, ok := l.Months[strings.ToLower(word)]
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(field, ",") {
+			month += ","
+		}
+		fields[i] = month
+	}
+	return strings.Join(fields, " ")
+}
+
+func init() {
+	RegisterLocale(&Locale{
+		Name:           "en",
+		ActivityFolder: "My Activity",
+		Actions: map[string]string{
+			"Listened to":                  "Listened to",
+			"Searched for":                 "Searched for",
+			"Visited":                      "Visited",
+			"Used":                         "Used",
+			"Viewed":                       "Viewed",
+			"Watched":                      "Watched",
+			"Dismissed notification about": "Dismissed notification about",
+			"Received notification about":  "Received notification about",
+			"Saw articles in":              "Saw articles in",
+			"Saw videos in":                "Saw videos in",
+			"Read":                         "Read",
+			"Watched a video in":           "Watched a video in",
+			"Said":                         "Said",
+		},
+		Sections: map[string]string{
+			"Products":  "Products",
+			"Locations": "Locations",
+			"Details":   "Details",
+		},
+	})
+
+	RegisterLocale(&Locale{
+		Name:           "de",
+		ActivityFolder: "Meine Aktivitäten",
+		Actions: map[string]string{
+			"Angehört":     "Listened to",
+			"Gesucht nach": "Searched for",
+			"Besucht":      "Visited",
+			"Verwendet":    "Used",
+			"Aufgerufen":   "Viewed",
+			"Angesehen":    "Watched",
+			"Gelesen":      "Read",
+			"Gesagt":       "Said",
+		},
+		Months: map[string]string{
+			"januar":    "Jan",
+			"jan":       "Jan",
+			"februar":   "Feb",
+			"feb":       "Feb",
+			"märz":      "Mar",
+			"mär":       "Mar",
+			"april":     "Apr",
+			"apr":       "Apr",
+			"mai":       "May",
+			"juni":      "Jun",
+			"jun":       "Jun",
+			"juli":      "Jul",
+			"jul":       "Jul",
+			"august":    "Aug",
+			"aug":       "Aug",
+			"september": "Sep",
+			"sept":      "Sep",
+			"sep":       "Sep",
+			"oktober":   "Oct",
+			"okt":       "Oct",
+			"november":  "Nov",
+			"nov":       "Nov",
+			"dezember":  "Dec",
+			"dez":       "Dec",
+		},
+		Sections: map[string]string{
+			"Produkte":  "Products",
+			"Standorte": "Locations",
+			"Details":   "Details",
+		},
+		DateLayouts: []string{
+			"2.1.2006, 15:04:05",
+		},
+		Zones: map[string]*time.Location{
+			"MEZ":  time.FixedZone("MEZ", 1*60*60),
+			"MESZ": time.FixedZone("MESZ", 2*60*60),
+		},
+	})
+
+	RegisterLocale(&Locale{
+		Name:           "fr",
+		ActivityFolder: "Mon activité",
+		Actions: map[string]string{
+			"Vous avez écouté":    "Listened to",
+			"Vous avez recherché": "Searched for",
+			"Vous avez visité":    "Visited",
+			"Vous avez utilisé":   "Used",
+			"Vous avez consulté":  "Viewed",
+			"Vous avez regardé":   "Watched",
+			"Vous avez lu":        "Read",
+			"Vous avez dit":       "Said",
+		},
+		Months: map[string]string{
+			"janvier":   "Jan",
+			"janv":      "Jan",
+			"février":   "Feb",
+			"févr":      "Feb",
+			"mars":      "Mar",
+			"avril":     "Apr",
+			"avr":       "Apr",
+			"mai":       "May",
+			"juin":      "Jun",
+			"juillet":   "Jul",
+			"juil":      "Jul",
+			"août":      "Aug",
+			"septembre": "Sep",
+			"sept":      "Sep",
+			"octobre":   "Oct",
+			"oct":       "Oct",
+			"novembre":  "Nov",
+			"nov":       "Nov",
+			"décembre":  "Dec",
+			"déc":       "Dec",
+		},
+		Sections: map[string]string{
+			"Produits": "Products",
+			"Lieux":    "Locations",
+			"Détails":  "Details",
+		},
+	})
+
+	RegisterLocale(&Locale{
+		Name:           "es",
+		ActivityFolder: "Mi actividad",
+		Actions: map[string]string{
+			"Has escuchado":  "Listened to",
+			"Has buscado":    "Searched for",
+			"Has visitado":   "Visited",
+			"Has usado":      "Used",
+			"Has utilizado":  "Used",
+			"Has consultado": "Viewed",
+			"Has visto":      "Watched",
+			"Has leído":      "Read",
+			"Has dicho":      "Said",
+		},
+		Months: map[string]string{
+			"enero":      "Jan",
+			"ene":        "Jan",
+			"febrero":    "Feb",
+			"feb":        "Feb",
+			"marzo":      "Mar",
+			"mar":        "Mar",
+			"abril":      "Apr",
+			"abr":        "Apr",
+			"mayo":       "May",
+			"may":        "May",
+			"junio":      "Jun",
+			"jun":        "Jun",
+			"julio":      "Jul",
+			"jul":        "Jul",
+			"agosto":     "Aug",
+			"ago":        "Aug",
+			"septiembre": "Sep",
+			"sept":       "Sep",
+			"sep":        "Sep",
+			"octubre":    "Oct",
+			"oct":        "Oct",
+			"noviembre":  "Nov",
+			"nov":        "Nov",
+			"diciembre":  "Dec",
+			"dic":        "Dec",
+		},
+		Sections: map[string]string{
+			"Productos":   "Products",
+			"Ubicaciones": "Locations",
+			"Detalles":    "Details",
+		},
+	})
+
+	RegisterLocale(&Locale{
+		Name:           "ja",
+		ActivityFolder: "マイアクティビティ",
+		Actions: map[string]string{
+			"を再生しました":   "Listened to",
+			"を検索しました":   "Searched for",
+			"にアクセスしました": "Visited",
+			"を使用しました":   "Used",
+			"を表示しました":   "Viewed",
+			"を視聴しました":   "Watched",
+			"を閲覧しました":   "Read",
+		},
+		Sections: map[string]string{
+			"サービス": "Products",
+			"場所":   "Locations",
+			"詳細":   "Details",
+		},
+		DateLayouts: []string{
+			"2006/1/2 15:04:05",
+		},
+	})
+}
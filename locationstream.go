@@ -0,0 +1,136 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DecodeError is a malformed record in a streamed file. Offset is the byte
+// after the previous record, so the bad one starts at the next '{'.
+type DecodeError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("At byte %d: %v", e.Offset, e.Err)
+}
+
+// StreamLocations decodes the "locations" array of a Location History.json or
+// Records.json one point at a time, so memory stays bounded however large the
+// file is. Returning an error from fn stops decoding and that error is
+// returned.
+func StreamLocations(r io.Reader, fn func(Location) error) error {
+	return StreamLocationsContext(context.Background(), r, fn)
+}
+
+// StreamLocationsContext is StreamLocations, checking ctx before each point
+func StreamLocationsContext(ctx context.Context, r io.Reader, fn func(Location) error) error {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return &DecodeError{Offset: dec.InputOffset(), Err: err}
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return &DecodeError{Offset: 0, Err: errors.New("Expected a JSON object")}
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return &DecodeError{Offset: dec.InputOffset(), Err: err}
+		}
+		if key, _ := tok.(string); key != "locations" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return &DecodeError{Offset: dec.InputOffset(), Err: err}
+			}
+			continue
+		}
+
+		err = streamLocationArray(ctx, dec, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return &DecodeError{Offset: dec.InputOffset(), Err: err}
+	}
+	return nil
+}
+
+func streamLocationArray(ctx context.Context, dec *json.Decoder, fn func(Location) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return &DecodeError{Offset: dec.InputOffset(), Err: err}
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return &DecodeError{Offset: dec.InputOffset(), Err: errors.New("Expected locations to be an array")}
+	}
+
+	for dec.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		offset := dec.InputOffset()
+		var input LocationInput
+		if err := dec.Decode(&input); err != nil {
+			return &DecodeError{Offset: offset, Err: err}
+		}
+		loc, err := FormatInput(input)
+		if err != nil {
+			return &DecodeError{Offset: offset, Err: err}
+		}
+		if err := fn(loc); err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return &DecodeError{Offset: dec.InputOffset(), Err: err}
+	}
+	return nil
+}
+
+// InsertLocationStream streams the points in r into "locationhistory",
+// committing every batchSize points. Points already stored are upserted.
+// Points in batches committed before an error stay in the database. It
+// returns how many new or updated points were written.
+func InsertLocationStream(db *sql.DB, r io.Reader, batchSize int) (int, error) {
+	return InsertLocationStreamContext(context.Background(), db, r, batchSize)
+}
+
+// InsertLocationStreamContext is InsertLocationStream, stopped when ctx is done
+func InsertLocationStreamContext(ctx context.Context, db *sql.DB, r io.Reader, batchSize int) (int, error) {
+	w := NewWriterContext(ctx, db, batchSize)
+	added := 0
+	err := StreamLocationsContext(ctx, r, func(loc Location) error {
+		o, err := w.UpsertLocation(loc)
+		if err != nil {
+			return err
+		}
+		if o != OutcomeDuplicate {
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		inserted := added - w.Pending()
+		w.Rollback()
+		return inserted, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return added - w.Pending(), err
+	}
+	return added, nil
+}
@@ -0,0 +1,128 @@
+package ParseTakeout
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamLocations(t *testing.T) {
+	for _, name := range []string{"Location-History-Sample.json", "Records-Sample.json"} {
+		f, err := os.Open(testHome + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := LoadJSON(testHome + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var streamed []Location
+		err = StreamLocations(f, func(loc Location) error {
+			streamed = append(streamed, loc)
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(streamed) != len(data.Locations) {
+			t.Fatalf("%s: expected %d locations, got %d", name, len(data.Locations), len(streamed))
+		}
+		for i, input := range data.Locations {
+			loc, err := FormatInput(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loc.UnixTimeMs != streamed[i].UnixTimeMs || len(loc.Activities) != len(streamed[i].Activities) {
+				t.Fatalf("%s: expected %v, got %v", name, loc, streamed[i])
+			}
+		}
+	}
+}
+
+func TestStreamLocationsErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int64
+	}{
+		{`[]`, 0},
+		{`{"locations": [{"timestampMs": "1000"}, {"timestampMs": "soon"}]}`, 38},
+		{`{"locations": [{"timestampMs": "1000"}, {"latitudeE7": "north"}]}`, 38},
+		{`{"locations": {}}`, 15},
+	}
+	for _, test := range tests {
+		err := StreamLocations(strings.NewReader(test.input), func(Location) error {
+			return nil
+		})
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("%s: expected a DecodeError, got %v", test.input, err)
+		}
+		if decodeErr.Offset != test.offset {
+			t.Fatalf("%s: expected offset %d, got %d (%v)", test.input, test.offset, decodeErr.Offset, err)
+		}
+	}
+
+	// Other keys are skipped
+	count := 0
+	err := StreamLocations(strings.NewReader(`{"version": {"a": [1]}, "locations": [{"timestamp": "2019-03-02T10:15:00Z"}]}`), func(Location) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 location, got %d (%v)", count, err)
+	}
+}
+
+func TestInsertLocationStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "stream.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := os.Open(testHome + "Location-History-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	inserted, err := InsertLocationStream(db, f, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 3 {
+		t.Fatalf("Expected 3 inserted, got %d", inserted)
+	}
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 3 || len(locations[2].Activities) != 3 {
+		t.Fatalf("Expected 3 locations with activities, got %v", locations)
+	}
+
+	// The first full batch is kept when a later record is bad
+	inserted, err = InsertLocationStream(db, strings.NewReader(`{"locations": [{"timestampMs": "1000"}, {"timestampMs": "2000"}, {"timestampMs": "x"}]}`), 2)
+	if err == nil || inserted != 2 {
+		t.Fatalf("Expected 2 inserted before an error, got %d (%v)", inserted, err)
+	}
+	locations, err = GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 5 {
+		t.Fatalf("Expected 5 locations, got %d", len(locations))
+	}
+}
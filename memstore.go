@@ -0,0 +1,449 @@
+package ParseTakeout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory and is lost on
+// Close. It follows SQLiteStore, including matching text the way LIKE does,
+// but keeps no Semantic Location History, so its summaries have no TopPlaces
+// or DistanceByActivity.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	items map[itemKey]Result
+	// locations are kept in insertion order, like rows in a table
+	locations []Location
+	// activities are keyed by their point, as in "locationactivity". Every
+	// stored point has an entry, so it is also how duplicates are found.
+	activities map[locationKey][]LocationActivity
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items:      map[itemKey]Result{},
+		activities: map[locationKey][]LocationActivity{},
+	}
+}
+
+// cloneResult copies res so the store and its callers don't share slices.
+// Empty lists become nil, as they do when read back from SQLite.
+func cloneResult(res Result) Result {
+	res.Products = append([]string(nil), res.Products...)
+	res.Details = append([]string(nil), res.Details...)
+	res.Locations = append([]ActivityLocation(nil), res.Locations...)
+	return res
+}
+
+// likeContains matches s against a LIKE '%sub%' pattern, which ignores the
+// case of ASCII letters only
+func likeContains(s, sub string) bool {
+	lower := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+			return r
+		}, s)
+	}
+	return strings.Contains(lower(s), lower(sub))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) InsertItem(ctx context.Context, res Result) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[res.key()]; ok {
+		return fmt.Errorf("Item %q %q at %d already stored", res.Action, res.Item, res.UnixTime)
+	}
+	s.items[res.key()] = cloneResult(res)
+	return nil
+}
+
+func (s *MemoryStore) InsertLocation(ctx context.Context, loc Location) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.activities[loc.key()]; ok {
+		return fmt.Errorf("Location %d,%d at %d already stored", loc.Latitude, loc.Longitude, loc.Unixtime)
+	}
+	s.activities[loc.key()] = append([]LocationActivity(nil), loc.Activities...)
+	loc.Activities = nil
+	s.locations = append(s.locations, loc)
+	return nil
+}
+
+// matches reports whether res is selected by q, leaving out paging
+func (q Query) matches(res Result) bool {
+	if q.Begin != 0 && res.UnixTime < q.Begin {
+		return false
+	}
+	if q.End != 0 && res.UnixTime >= q.End {
+		return false
+	}
+	if len(q.Titles) > 0 && !containsString(q.Titles, res.Title) {
+		return false
+	}
+	if len(q.Actions) > 0 && !containsString(q.Actions, res.Action) {
+		return false
+	}
+	if len(q.Channels) > 0 && !containsString(q.Channels, res.Channel) {
+		return false
+	}
+	if len(q.Products) > 0 {
+		found := false
+		for _, product := range res.Products {
+			found = found || containsString(q.Products, product)
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Text != "" && !likeContains(res.Item, q.Text) {
+		return false
+	}
+	return true
+}
+
+// cursorLess orders a before b as a query sorted ascending does
+func cursorLess(a, b Cursor) bool {
+	if a.UnixTime != b.UnixTime {
+		return a.UnixTime < b.UnixTime
+	}
+	if a.Action != b.Action {
+		return a.Action < b.Action
+	}
+	return a.Item < b.Item
+}
+
+func (s *MemoryStore) GetItems(ctx context.Context, q Query) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if q.Sort != SortAscending && q.Sort != SortDescending {
+		return nil, fmt.Errorf("Invalid sort order %d", q.Sort)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	less := func(a, b Cursor) bool {
+		if q.Sort == SortDescending {
+			return cursorLess(b, a)
+		}
+		return cursorLess(a, b)
+	}
+
+	results := []Result{}
+	for _, res := range s.items {
+		if !q.matches(res) {
+			continue
+		}
+		if q.After != nil && !less(*q.After, res.cursor()) {
+			continue
+		}
+		results = append(results, cloneResult(res))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return less(results[i].cursor(), results[j].cursor())
+	})
+
+	if q.Offset > 0 {
+		if q.Offset > len(results) {
+			q.Offset = len(results)
+		}
+		results = results[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(results) {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// locationsBetween returns copies of the points in [begin, end] with their
+// activities, by time, then latitude and longitude
+func (s *MemoryStore) locationsBetween(begin, end int64) []Location {
+	results := []Location{}
+	for _, loc := range s.locations {
+		if loc.Unixtime < begin || loc.Unixtime > end {
+			continue
+		}
+		activities := append([]LocationActivity(nil), s.activities[loc.key()]...)
+		sort.SliceStable(activities, func(i, j int) bool {
+			if activities[i].Unixtime != activities[j].Unixtime {
+				return activities[i].Unixtime < activities[j].Unixtime
+			}
+			return activities[i].Confidence > activities[j].Confidence
+		})
+		loc.Activities = activities
+		if len(activities) == 0 {
+			loc.Activities = nil
+		}
+		results = append(results, loc)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Unixtime != b.Unixtime {
+			return a.Unixtime < b.Unixtime
+		}
+		if a.Latitude != b.Latitude {
+			return a.Latitude < b.Latitude
+		}
+		return a.Longitude < b.Longitude
+	})
+	return results
+}
+
+func (s *MemoryStore) GetLocations(ctx context.Context, begin, end int64) ([]Location, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	last := int64(1<<63 - 1)
+	if end != 0 {
+		last = end - 1
+	}
+	if begin == 0 {
+		begin = -1 << 63
+	}
+	return s.locationsBetween(begin, last), nil
+}
+
+// matches reports whether res is selected by the filter
+func (f ItemFilter) matches(res Result) bool {
+	if f.Title != "" && res.Title != f.Title {
+		return false
+	}
+	if f.Action != "" && res.Action != f.Action {
+		return false
+	}
+	if f.Item != "" && res.Item != f.Item {
+		return false
+	}
+	if f.Product != "" && !containsString(res.Products, f.Product) {
+		return false
+	}
+	if f.Search != "" && !likeContains(res.Item, f.Search) {
+		return false
+	}
+	if f.Begin != 0 && res.UnixTime < f.Begin {
+		return false
+	}
+	if f.End != 0 && res.UnixTime >= f.End {
+		return false
+	}
+	return true
+}
+
+func (s *MemoryStore) DeleteItems(ctx context.Context, filter ItemFilter) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if where, _ := filter.where(); where == "" {
+		return 0, errors.New("Empty filter")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for key, res := range s.items {
+		if filter.matches(res) {
+			delete(s.items, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) DeleteLocation(ctx context.Context, loc Location) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.locations[:0]
+	for _, stored := range s.locations {
+		if stored.key() != loc.key() {
+			kept = append(kept, stored)
+		}
+	}
+	s.locations = kept
+	delete(s.activities, loc.key())
+	return nil
+}
+
+func (s *MemoryStore) GetYears(ctx context.Context, loc *time.Location) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.years(loc), nil
+}
+
+func (s *MemoryStore) years(loc *time.Location) []int {
+	years := []int{}
+	if len(s.items) == 0 {
+		return years
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	first := true
+	var min, max int64
+	for _, res := range s.items {
+		if first || res.UnixTime < min {
+			min = res.UnixTime
+		}
+		if first || res.UnixTime > max {
+			max = res.UnixTime
+		}
+		first = false
+	}
+	for i := time.Unix(min, 0).In(loc).Year(); i <= time.Unix(max, 0).In(loc).Year(); i++ {
+		years = append(years, i)
+	}
+	return years
+}
+
+// topCounts counts the non empty names, most frequent first, keeping at most
+// 10 like the summary queries
+func topCounts(names []string) []ItemFreq {
+	counts := map[string]int{}
+	for _, name := range names {
+		if name != "" {
+			counts[name]++
+		}
+	}
+	var freqs []ItemFreq
+	for name, count := range counts {
+		freqs = append(freqs, ItemFreq{Name: name, Count: count})
+	}
+	sort.Slice(freqs, func(i, j int) bool {
+		if freqs[i].Count != freqs[j].Count {
+			return freqs[i].Count > freqs[j].Count
+		}
+		return freqs[i].Name < freqs[j].Name
+	})
+	if len(freqs) > 10 {
+		freqs = freqs[:10]
+	}
+	return freqs
+}
+
+// itemCounts summarises the items in [begin, end]
+func (s *MemoryStore) itemCounts(begin, end int64) (common []ItemFreq, channels []ChannelFreq, total, youtube int) {
+	var items, channelNames []string
+	for _, res := range s.items {
+		if res.UnixTime < begin || res.UnixTime > end {
+			continue
+		}
+		total++
+		items = append(items, res.Item)
+		if res.Channel != "" {
+			youtube++
+			channelNames = append(channelNames, res.Channel)
+		}
+	}
+	common = topCounts(items)
+	for _, freq := range topCounts(channelNames) {
+		channels = append(channels, ChannelFreq{Name: freq.Name, Count: freq.Count})
+	}
+	return common, channels, total, youtube
+}
+
+func (s *MemoryStore) GetSummaryofYear(ctx context.Context, year int, loc *time.Location) (*YearlySummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.summaryOfYear(year, loc), nil
+}
+
+func (s *MemoryStore) summaryOfYear(year int, loc *time.Location) *YearlySummary {
+	if loc == nil {
+		loc = time.UTC
+	}
+	begin, end := calculateUnixRangeOfYear(year, loc)
+
+	var monthly []MonthSummary
+	for month := time.January; month <= time.December; month++ {
+		mBegin := time.Date(year, month, 1, 0, 0, 0, 0, loc).Unix()
+		mEnd := time.Date(year, month+1, 1, 0, 0, 0, 0, loc).Unix() - 1
+		_, _, total, _ := s.itemCounts(mBegin, mEnd)
+		monthly = append(monthly, MonthSummary{
+			Name:  month.String(),
+			Begin: mBegin,
+			End:   mEnd,
+			Total: total,
+		})
+	}
+
+	common, channels, total, youtube := s.itemCounts(begin, end)
+	return &YearlySummary{
+		Year:          year,
+		Monthly:       monthly,
+		MostCommon:    common,
+		ChannelCommon: channels,
+		Total:         total,
+		YoutubeTotal:  youtube,
+		LocationData:  s.locationsBetween(begin, end),
+	}
+}
+
+func (s *MemoryStore) GetTotalSummary(ctx context.Context, loc *time.Location) (*TotalSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var yearSums []YearlySummary
+	for _, year := range s.years(loc) {
+		yearSums = append(yearSums, *s.summaryOfYear(year, loc))
+	}
+
+	common, channels, total, youtube := s.itemCounts(-1<<63, 1<<63-1)
+	return &TotalSummary{
+		MostCommon:    common,
+		YoutubeTotal:  youtube,
+		ChannelCommon: channels,
+		Total:         total,
+		Yearly:        yearSums,
+		LocationData:  s.locationsBetween(-1<<63, 1<<63-1),
+	}, nil
+}
+
+// Close empties the store
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = map[itemKey]Result{}
+	s.locations = nil
+	s.activities = map[locationKey][]LocationActivity{}
+	return nil
+}
@@ -0,0 +1,601 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migration upgrades the schema by one version. Migrations run in order inside
+// their own transaction, and must cope with databases created before the
+// schema_version table existed, which already have some of their changes.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "Create items and locationhistory", createBaseTables},
+	{2, "Add link columns to items", addLinkColumns},
+	{3, "Add utcoffset to items", addOffsetColumn},
+	{4, "Create item products, details and locations", createItemDetailTables},
+	{5, "Store text unescaped", unescapeLegacyText},
+	{6, "Add full location history records", addLocationRecordColumns},
+	{7, "Add millisecond location times", addLocationMillisColumn},
+	{8, "Create semantic location history tables", createSemanticTables},
+	{9, "Add content hashes and unique keys", addContentHashes},
+	{10, "Record imports", createImports},
+	{11, "Index item times", indexItemTimes},
+	{12, "Cache summaries", createSummaryCache},
+	{13, "Key location activities by point", keyLocationActivities},
+	{14, "Keep records imports replace", createReplacedRecords},
+	{15, "Index item detail keys", indexItemDetailKeys},
+}
+
+// LatestSchemaVersion is the version OpenDB migrates databases to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the last migration applied to db, 0 for a database
+// that has never been migrated
+func SchemaVersion(db *sql.DB) (int, error) {
+	return SchemaVersionContext(context.Background(), db)
+}
+
+// SchemaVersionContext is SchemaVersion, stopped when ctx is done
+func SchemaVersionContext(ctx context.Context, db *sql.DB) (int, error) {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS "schema_version" (
+		"version"	INTEGER PRIMARY KEY,
+		"description"	TEXT,
+		"applied"	INTEGER
+	);
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRowContext(ctx, `SELECT MAX("version") FROM "schema_version";`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	current, err := SchemaVersionContext(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = m.up(tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d (%s): %v", m.version, m.description, err)
+		}
+		_, err = tx.Exec(`
+		INSERT INTO "schema_version" ("version", "description", "applied")
+		VALUES (?, ?, ?);
+		`, m.version, m.description, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, colType string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info("%s");`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notNull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf(`
+	ALTER TABLE "%s" ADD COLUMN "%s" %s;
+	`, table, column, colType))
+	return err
+}
+
+func createBaseTables(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "items" (
+		"title"	TEXT,
+		"action"	TEXT,
+		"item"	TEXT,
+		"channel"	TEXT,
+		"date"	TEXT,
+		"unixtime"	INTEGER,
+		PRIMARY KEY("action","unixtime","item")
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "locationhistory" (
+		"unixtime"	INTEGER,
+		"latitude"	INTEGER,
+		"longitude"	INTEGER
+	);
+	`)
+}
+
+func addLinkColumns(tx *sql.Tx) error {
+	err := addColumnIfMissing(tx, "items", "url", "TEXT")
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "items", "channelurl", "TEXT")
+}
+
+func addOffsetColumn(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "items", "utcoffset", "INTEGER")
+}
+
+// Products, details and locations from an item's caption are stored in child
+// tables keyed by the same ("action", "unixtime", "item") as "items"
+func createItemDetailTables(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "itemproducts" (
+		"action"	TEXT,
+		"unixtime"	INTEGER,
+		"item"	TEXT,
+		"product"	TEXT
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "itemdetails" (
+		"action"	TEXT,
+		"unixtime"	INTEGER,
+		"item"	TEXT,
+		"detail"	TEXT
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "itemlocations" (
+		"action"	TEXT,
+		"unixtime"	INTEGER,
+		"item"	TEXT,
+		"name"	TEXT,
+		"url"	TEXT,
+		"latitude"	REAL,
+		"longitude"	REAL
+	);
+	`)
+}
+
+func addLocationRecordColumns(tx *sql.Tx) error {
+	columns := []struct{ name, colType string }{
+		{"accuracy", "INTEGER"},
+		{"altitude", "INTEGER"},
+		{"verticalaccuracy", "INTEGER"},
+		{"velocity", "INTEGER"},
+		{"heading", "INTEGER"},
+		{"source", "TEXT"},
+		{"devicetag", "INTEGER"},
+	}
+	for _, c := range columns {
+		err := addColumnIfMissing(tx, "locationhistory", c.name, c.colType)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Activities are keyed by the "unixtime" of their location
+	return execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "locationactivity" (
+		"locationtime"	INTEGER,
+		"unixtime"	INTEGER,
+		"type"	TEXT,
+		"confidence"	INTEGER
+	);
+	`)
+}
+
+func addLocationMillisColumn(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "locationhistory", "unixtimems", "INTEGER")
+}
+
+// Waypoints are keyed by the "starttime" of their segment
+func createSemanticTables(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "placevisits" (
+		"starttime"	INTEGER,
+		"endtime"	INTEGER,
+		"latitude"	INTEGER,
+		"longitude"	INTEGER,
+		"placeid"	TEXT,
+		"name"	TEXT,
+		"address"	TEXT,
+		"confidence"	TEXT,
+		"visitconfidence"	INTEGER
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "activitysegments" (
+		"starttime"	INTEGER,
+		"endtime"	INTEGER,
+		"startlatitude"	INTEGER,
+		"startlongitude"	INTEGER,
+		"endlatitude"	INTEGER,
+		"endlongitude"	INTEGER,
+		"distance"	INTEGER,
+		"activitytype"	TEXT,
+		"confidence"	TEXT
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "activitywaypoints" (
+		"starttime"	INTEGER,
+		"seq"	INTEGER,
+		"latitude"	INTEGER,
+		"longitude"	INTEGER
+	);
+	`)
+}
+
+// addContentHashes adds the "hash" column upserts compare and the unique keys
+// they conflict on, dropping the duplicate rows earlier imports left behind.
+// Hashes of existing rows are filled in by backfillHashes.
+func addContentHashes(tx *sql.Tx) error {
+	for _, table := range []string{"items", "locationhistory", "placevisits", "activitysegments"} {
+		err := addColumnIfMissing(tx, table, "hash", "TEXT")
+		if err != nil {
+			return err
+		}
+	}
+
+	return execAll(tx, `
+	DELETE FROM "locationhistory" WHERE "rowid" NOT IN (
+		SELECT MIN("rowid") FROM "locationhistory"
+		GROUP BY "unixtime", "latitude", "longitude"
+	);
+	`, `
+	DELETE FROM "locationactivity" WHERE "rowid" NOT IN (
+		SELECT MIN("rowid") FROM "locationactivity"
+		GROUP BY "locationtime", "unixtime", "type", "confidence"
+	);
+	`, `
+	DELETE FROM "placevisits" WHERE "rowid" NOT IN (
+		SELECT MIN("rowid") FROM "placevisits" GROUP BY "starttime"
+	);
+	`, `
+	DELETE FROM "activitysegments" WHERE "rowid" NOT IN (
+		SELECT MIN("rowid") FROM "activitysegments" GROUP BY "starttime"
+	);
+	`, `
+	DELETE FROM "activitywaypoints" WHERE "rowid" NOT IN (
+		SELECT MIN("rowid") FROM "activitywaypoints" GROUP BY "starttime", "seq"
+	);
+	`, `
+	CREATE UNIQUE INDEX IF NOT EXISTS "locationhistory_key" ON "locationhistory" ("unixtime", "latitude", "longitude");
+	`, `
+	CREATE UNIQUE INDEX IF NOT EXISTS "placevisits_key" ON "placevisits" ("starttime");
+	`, `
+	CREATE UNIQUE INDEX IF NOT EXISTS "activitysegments_key" ON "activitysegments" ("starttime");
+	`, `
+	CREATE UNIQUE INDEX IF NOT EXISTS "activitywaypoints_key" ON "activitywaypoints" ("starttime", "seq");
+	`)
+}
+
+// Rows written before imports were recorded have a NULL "importid"
+func createImports(tx *sql.Tx) error {
+	err := execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "imports" (
+		"id"	INTEGER PRIMARY KEY AUTOINCREMENT,
+		"archive"	TEXT,
+		"path"	TEXT,
+		"filehash"	TEXT,
+		"parser"	TEXT,
+		"started"	INTEGER,
+		"finished"	INTEGER,
+		"new"	INTEGER DEFAULT 0,
+		"duplicate"	INTEGER DEFAULT 0,
+		"updated"	INTEGER DEFAULT 0,
+		"skipped"	INTEGER DEFAULT 0
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"items", "locationhistory", "placevisits", "activitysegments"} {
+		err := addColumnIfMissing(tx, table, "importid", "INTEGER")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`
+		CREATE INDEX IF NOT EXISTS "%s_importid" ON "%s" ("importid");
+		`, table, table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexItemTimes lets summaries and time ranges seek to the items they need,
+// as "unixtime" is not the first column of the primary key
+func indexItemTimes(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE INDEX IF NOT EXISTS "items_unixtime" ON "items" ("unixtime");
+	`)
+}
+
+// summarySources are the tables summaries are built from, with the column
+// placing each row in a year and the columns summaries read
+var summarySources = []struct {
+	table   string
+	time    string
+	columns []string
+}{
+	{"items", "unixtime", []string{"unixtime", "item", "channel"}},
+	{"placevisits", "starttime", []string{"starttime", "endtime", "placeid", "name", "address"}},
+	{"activitysegments", "starttime", []string{"starttime", "distance", "activitytype"}},
+}
+
+// createSummaryCache adds the tables summaries are cached in and the triggers
+// marking them stale. A change to a source row marks every total and the
+// years holding its old and new times; locations aren't cached, so changing
+// them marks nothing.
+func createSummaryCache(tx *sql.Tx) error {
+	err := execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "summarytotals" (
+		"zone"	TEXT PRIMARY KEY,
+		"stale"	INTEGER NOT NULL DEFAULT 0,
+		"years"	TEXT,
+		"total"	INTEGER,
+		"youtubetotal"	INTEGER,
+		"mostcommon"	TEXT,
+		"channelcommon"	TEXT
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "summaryyears" (
+		"zone"	TEXT,
+		"year"	INTEGER,
+		"begin"	INTEGER,
+		"end"	INTEGER,
+		"stale"	INTEGER NOT NULL DEFAULT 0,
+		"total"	INTEGER,
+		"youtubetotal"	INTEGER,
+		"mostcommon"	TEXT,
+		"channelcommon"	TEXT,
+		"topplaces"	TEXT,
+		"distancebyactivity"	TEXT,
+		PRIMARY KEY ("zone", "year")
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS "summarymonths" (
+		"zone"	TEXT,
+		"year"	INTEGER,
+		"month"	INTEGER,
+		"begin"	INTEGER,
+		"end"	INTEGER,
+		"total"	INTEGER,
+		PRIMARY KEY ("zone", "year", "month")
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	stale := func(times ...string) string {
+		conds := make([]string, len(times))
+		for i, t := range times {
+			conds[i] = t + ` BETWEEN "begin" AND "end"`
+		}
+		return `
+		UPDATE "summaryyears" SET "stale" = 1 WHERE "stale" = 0 AND (` + strings.Join(conds, " OR ") + `);
+		UPDATE "summarytotals" SET "stale" = 1 WHERE "stale" = 0;`
+	}
+	for _, src := range summarySources {
+		oldTime, newTime := `OLD."`+src.time+`"`, `NEW."`+src.time+`"`
+		_, err := tx.Exec(fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS "%[1]s_summaries_insert" AFTER INSERT ON "%[1]s" BEGIN%[2]s
+		END;
+		CREATE TRIGGER IF NOT EXISTS "%[1]s_summaries_delete" AFTER DELETE ON "%[1]s" BEGIN%[3]s
+		END;
+		CREATE TRIGGER IF NOT EXISTS "%[1]s_summaries_update" AFTER UPDATE OF "%[4]s" ON "%[1]s" BEGIN%[5]s
+		END;
+		`, src.table, stale(newTime), stale(oldTime), strings.Join(src.columns, `", "`), stale(oldTime, newTime)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyLocationActivities adds the coordinates of their point to activities, so
+// points sharing a second keep their own. Activities stored before can't be
+// told apart, so each point at their time gets a copy, as they were read
+// back before.
+func keyLocationActivities(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE "locationactivity_keyed" (
+		"locationtime"	INTEGER,
+		"locationlatitude"	INTEGER,
+		"locationlongitude"	INTEGER,
+		"unixtime"	INTEGER,
+		"type"	TEXT,
+		"confidence"	INTEGER
+	);
+	`, `
+	INSERT INTO "locationactivity_keyed"
+	SELECT DISTINCT a."locationtime", h."latitude", h."longitude", a."unixtime", a."type", a."confidence"
+	FROM "locationactivity" AS a JOIN "locationhistory" AS h ON h."unixtime" = a."locationtime";
+	`, `
+	DROP TABLE "locationactivity";
+	`, `
+	ALTER TABLE "locationactivity_keyed" RENAME TO "locationactivity";
+	`, `
+	CREATE INDEX IF NOT EXISTS "locationactivity_point" ON "locationactivity" ("locationtime", "locationlatitude", "locationlongitude");
+	`)
+}
+
+// createReplacedRecords adds the table the earlier version of each record an
+// import updates is kept in, so rolling the import back can restore it. The
+// record is stored as JSON, keyed by its kind and the JSON of its unique key.
+func createReplacedRecords(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE IF NOT EXISTS "replacedrecords" (
+		"importid"	INTEGER,
+		"kind"	TEXT,
+		"key"	TEXT,
+		"previousimportid"	INTEGER,
+		"record"	TEXT
+	);
+	`, `
+	CREATE INDEX IF NOT EXISTS "replacedrecords_importid" ON "replacedrecords" ("importid");
+	`, `
+	CREATE INDEX IF NOT EXISTS "replacedrecords_previousimportid" ON "replacedrecords" ("previousimportid");
+	`)
+}
+
+// itemDetailTables are the child tables of "items", keyed by its
+// ("action", "unixtime", "item")
+var itemDetailTables = []string{"itemproducts", "itemdetails", "itemlocations"}
+
+// indexItemDetailKeys indexes the child tables of items by their key, so
+// reading or replacing the products, details and locations of an item doesn't
+// scan every row
+func indexItemDetailKeys(tx *sql.Tx) error {
+	for _, table := range itemDetailTables {
+		_, err := tx.Exec(fmt.Sprintf(`
+		CREATE INDEX IF NOT EXISTS "%s_key" ON "%s" ("action", "unixtime", "item");
+		`, table, table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unescapeLegacyText converts databases written before text was stored as
+// plain UTF-8, when every column was url.QueryEscape'd. Databases that went
+// through this before schema_version existed have a user_version of 1.
+func unescapeLegacyText(tx *sql.Tx) error {
+	var version int
+	err := tx.QueryRow(`PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version >= 1 {
+		return nil
+	}
+
+	tables := map[string][]string{
+		"items":         {"title", "action", "item", "channel", "date", "url", "channelurl"},
+		"itemproducts":  {"action", "item", "product"},
+		"itemdetails":   {"action", "item", "detail"},
+		"itemlocations": {"action", "item", "name", "url"},
+	}
+	for table, columns := range tables {
+		err = unescapeTable(tx, table, columns)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`PRAGMA user_version = 1;`)
+	return err
+}
+
+func unescapeTable(tx *sql.Tx, table string, columns []string) error {
+	quoted := make([]string, len(columns))
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = `IFNULL("` + column + `", '')`
+		assignments[i] = `"` + column + `" = ?`
+	}
+
+	rows, err := tx.Query(`SELECT rowid, ` + strings.Join(quoted, ", ") + ` FROM "` + table + `";`)
+	if err != nil {
+		return err
+	}
+	type update struct {
+		rowid  int64
+		values []interface{}
+	}
+	var updates []update
+	for rows.Next() {
+		var rowid int64
+		values := make([]string, len(columns))
+		dest := []interface{}{&rowid}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+
+		changed := false
+		args := make([]interface{}, len(values))
+		for i, value := range values {
+			unescaped, err := url.QueryUnescape(value)
+			if err != nil {
+				unescaped = value
+			}
+			changed = changed || unescaped != value
+			args[i] = unescaped
+		}
+		if changed {
+			updates = append(updates, update{rowid: rowid, values: args})
+		}
+	}
+	rows.Close()
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range updates {
+		_, err := tx.Exec(`UPDATE "`+table+`" SET `+strings.Join(assignments, ", ")+` WHERE rowid = ?;`, append(u.values, u.rowid)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,23 +1,38 @@
 package ParseTakeout
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
-	"net/url"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Result struct {
-	Title    string `json:"title"`
-	Action   string `json:"action"`
-	Item     string `json:"item"`
-	Channel  string `json:"channel"`
-	Date     string `json:"date"`
-	UnixTime int64  `json:"unixtime"`
+	Title      string `json:"title"`
+	Action     string `json:"action"`
+	Item       string `json:"item"`
+	URL        string `json:"url"`
+	Channel    string `json:"channel"`
+	ChannelURL string `json:"channelurl"`
+	Date       string `json:"date"`
+	UnixTime   int64  `json:"unixtime"`
+	UTCOffset  int    `json:"utcoffset"`
+
+	Products  []string           `json:"products"`
+	Details   []string           `json:"details"`
+	Locations []ActivityLocation `json:"locations"`
+}
+
+type ActivityLocation struct {
+	Name      string  `json:"name"`
+	URL       string  `json:"url"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
 }
 
 type TotalSummary struct {
@@ -37,6 +52,9 @@ type YearlySummary struct {
 	Total         int            `json:"total"`
 	Monthly       []MonthSummary `json:"monthly"`
 	LocationData  []Location     `json:"locationdata"`
+
+	TopPlaces          []PlaceFreq        `json:"topplaces"`
+	DistanceByActivity []ActivityDistance `json:"distancebyactivity"`
 }
 
 type MonthSummary struct {
@@ -63,18 +81,21 @@ func (r Result) String() string {
 	Title: %s
 	Action: %s
 	Item: %s
+	URL: %s
 	Date: %s
 	UnixTime: %d
-	*****`, r.Title, r.Action, r.Item, r.Date, r.UnixTime)
+	*****`, r.Title, r.Action, r.Item, r.URL, r.Date, r.UnixTime)
 	} else {
 		s = fmt.Sprintf(`*****
 	Title: %s
 	Action: %s
 	Item: %s
+	URL: %s
 	Channel: %s
+	ChannelURL: %s
 	Date: %s
 	UnixTime: %d
-	*****`, r.Title, r.Action, r.Item, r.Channel, r.Date, r.UnixTime)
+	*****`, r.Title, r.Action, r.Item, r.URL, r.Channel, r.ChannelURL, r.Date, r.UnixTime)
 	}
 	return s
 }
@@ -102,45 +123,30 @@ func (r Result) Validate() error {
 }
 
 func OpenDB(dbPath string) (*sql.DB, error) {
+	return OpenDBContext(context.Background(), dbPath)
+}
+
+// OpenDBContext is OpenDB, stopped when ctx is done
+func OpenDBContext(ctx context.Context, dbPath string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Printf("Error opening")
 		return nil, err
 	}
 
-	sqlStmt, err := db.Prepare(`
-	CREATE TABLE IF NOT EXISTS "items" (
-		"title"	TEXT,
-		"action"	TEXT,
-		"item"	TEXT,
-		"channel"	TEXT,
-		"date"	TEXT,
-		"unixtime"	INTEGER,
-		PRIMARY KEY("action","unixtime","item")
-	);
-	`)
+	err = migrate(ctx, db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-
-	_, err = sqlStmt.Exec()
+	err = backfillHashes(ctx, db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-
-	sqlStmt, err = db.Prepare(`
-	CREATE TABLE IF NOT EXISTS "locationhistory" (
-		"unixtime"	INTEGER,
-		"latitude"	INTEGER,
-		"longitude"	INTEGER
-	);
-	`)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = sqlStmt.Exec()
+	err = ensureSearchIndex(ctx, db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -148,25 +154,40 @@ func OpenDB(dbPath string) (*sql.DB, error) {
 }
 
 func InsertItem(db *sql.DB, res Result) error {
-	_, err := db.Exec(fmt.Sprintf(`
-	INSERT INTO "items" ("title", "action", "item", "channel", "date", "unixtime")
-	VALUES ("%s", "%s", "%s", "%s", "%s", "%d");
-	`, url.QueryEscape(res.Title), url.QueryEscape(res.Action), url.QueryEscape(res.Item), url.QueryEscape(res.Channel), url.QueryEscape(res.Date), res.UnixTime))
+	return InsertItemContext(context.Background(), db, res)
+}
+
+// InsertItemContext is InsertItem, stopped when ctx is done
+func InsertItemContext(ctx context.Context, db *sql.DB, res Result) error {
+	return insertItem(ctx, db, res, sql.NullInt64{})
+}
+
+func insertItem(ctx context.Context, db execer, res Result, importID sql.NullInt64) error {
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO "items" ("title", "action", "item", "channel", "date", "unixtime", "url", "channelurl", "utcoffset", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, res.Title, res.Action, res.Item, res.Channel, res.Date, res.UnixTime, res.URL, res.ChannelURL, res.UTCOffset, res.Hash(), importID)
 	if err != nil {
 		return err
 	}
-	return nil
+	return insertItemDetails(ctx, db, res)
 }
 
+// DeleteItem deletes the item with the same action, time and item as res,
+// along with its products, details and locations
 func DeleteItem(db *sql.DB, res Result) error {
-	_, err := db.Exec(fmt.Sprintf(`
-	DELETE FROM "items" WHERE
-	"unixtime" = "%d";
-	`, res.UnixTime))
-	if err != nil {
-		return err
-	}
-	return nil
+	return DeleteItemContext(context.Background(), db, res)
+}
+
+// DeleteItemContext is DeleteItem, stopped when ctx is done
+func DeleteItemContext(ctx context.Context, db *sql.DB, res Result) error {
+	_, err := DeleteItemsContext(ctx, db, ItemFilter{
+		Action: res.Action,
+		Item:   res.Item,
+		Begin:  res.UnixTime,
+		End:    res.UnixTime + 1,
+	})
+	return err
 }
 
 func parseRows(rows *sql.Rows) ([]Result, error) {
@@ -180,22 +201,23 @@ func parseRows(rows *sql.Rows) ([]Result, error) {
 		var channel string
 		var date string
 		var unixtime int64
-		if err := rows.Scan(&title, &action, &item, &channel, &date, &unixtime); err != nil {
+		var link sql.NullString
+		var channelLink sql.NullString
+		var offset sql.NullInt64
+		if err := rows.Scan(&title, &action, &item, &channel, &date, &unixtime, &link, &channelLink, &offset); err != nil {
 			return nil, err
 		}
-		title, _ = url.QueryUnescape(title)
-		action, _ = url.QueryUnescape(action)
-		item, _ = url.QueryUnescape(item)
-		channel, _ = url.QueryUnescape(channel)
-		date, _ = url.QueryUnescape(date)
 
 		results = append(results, Result{
-			Title:    title,
-			Action:   action,
-			Item:     item,
-			Channel:  channel,
-			Date:     date,
-			UnixTime: unixtime,
+			Title:      title,
+			Action:     action,
+			Item:       item,
+			URL:        link.String,
+			Channel:    channel,
+			ChannelURL: channelLink.String,
+			Date:       date,
+			UnixTime:   unixtime,
+			UTCOffset:  int(offset.Int64),
 		})
 	}
 	// Check for errors from iterating over rows.
@@ -205,10 +227,13 @@ func parseRows(rows *sql.Rows) ([]Result, error) {
 	return results, nil
 }
 
-func GetAllItems(db *sql.DB) ([]Result, error) {
-	rows, err := db.Query(`
-	SELECT * FROM "items";
-	`)
+// queryItems selects the items matching where along with their products,
+// details and locations
+func queryItems(ctx context.Context, db queryer, where string, args ...interface{}) ([]Result, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "title", "action", "item", "channel", "date", "unixtime", "url", "channelurl", "utcoffset"
+	FROM "items" `+where+`;
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -218,28 +243,7 @@ func GetAllItems(db *sql.DB) ([]Result, error) {
 		return nil, err
 	}
 
-	return results, nil
-}
-
-func calculateUnixRangeOfYear(year int) (int64, int64) {
-	begin := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
-	end := time.Date(year, 12, 31, 23, 59, 59, 0, time.UTC).Unix()
-
-	return begin, end
-}
-
-func GetItemsFromYear(db *sql.DB, year int) ([]Result, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-
-	rows, err := db.Query(fmt.Sprintf(`
-	SELECT * FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d;
-	`, begin, end))
-	if err != nil {
-		return nil, err
-	}
-
-	results, err := parseRows(rows)
+	err = attachItemDetails(ctx, db, results)
 	if err != nil {
 		return nil, err
 	}
@@ -247,454 +251,102 @@ func GetItemsFromYear(db *sql.DB, year int) ([]Result, error) {
 	return results, nil
 }
 
-func GetItemsFromUnixtime(db *sql.DB, begin, end int64) ([]Result, error) {
-	rows, err := db.Query(fmt.Sprintf(`
-	SELECT * FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d;
-	`, begin, end))
-	if err != nil {
-		return nil, err
-	}
-
-	results, err := parseRows(rows)
-	if err != nil {
-		return nil, err
-	}
-
-	return results, nil
+func GetAllItems(db *sql.DB) ([]Result, error) {
+	return GetAllItemsContext(context.Background(), db)
 }
 
-func constructMonthlySummary(db *sql.DB, year int) ([]MonthSummary, error) {
-	months := []string{
-		"January",
-		"February",
-		"March",
-		"April",
-		"May",
-		"June",
-		"July",
-		"August",
-		"September",
-		"October",
-		"November",
-		"December",
-	}
-
-	var mSum []MonthSummary
-
-	var monthCount time.Month = 1
-	for _, month := range months {
-		begin := time.Date(year, monthCount, 1, 0, 0, 0, 0, time.UTC).Unix()
-		end := time.Date(year, monthCount+1, 0, 23, 59, 59, 999999999, time.UTC).Unix()
-
-		sum, err := db.Query(fmt.Sprintf(`
-		SELECT COUNT(*) FROM "items"
-		WHERE "unixtime" > %d AND "unixtime" < %d;
-		`, begin, end))
-		if err != nil {
-			return nil, err
-		}
-		defer sum.Close()
-
-		var sumCount int
-		for sum.Next() {
-			if err := sum.Scan(&sumCount); err != nil {
-				return nil, err
-			}
-		}
-		// Check for errors from iterating over rows.
-		if err := sum.Err(); err != nil {
-			return nil, err
-		}
-
-		mSum = append(mSum, MonthSummary{
-			Name:  month,
-			Begin: begin,
-			End:   end,
-			Total: sumCount,
-		})
-
-		monthCount++
-	}
-
-	return mSum, nil
+// GetAllItemsContext is GetAllItems, stopped when ctx is done
+func GetAllItemsContext(ctx context.Context, db *sql.DB) ([]Result, error) {
+	return GetItemsContext(ctx, db, Query{})
 }
 
-func getMostCommonForYear(db *sql.DB, year int) ([]ItemFreq, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-
-	freqs, err := db.Query(fmt.Sprintf(`
-	SELECT "item", COUNT(*) AS FREQ
-	FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d
-	GROUP BY "item"
-	ORDER BY COUNT(*) DESC
-	LIMIT 10;
-	`, begin, end))
-	if err != nil {
-		return nil, err
-	}
-	defer freqs.Close()
-
-	var itemFreqs []ItemFreq
-	for freqs.Next() {
-		var freqTotal int
-		var item string
-		if err := freqs.Scan(&item, &freqTotal); err != nil {
-			return nil, err
-		}
-		item, _ = url.QueryUnescape(item)
-		itemFreqs = append(itemFreqs, ItemFreq{
-			Name:  item,
-			Count: freqTotal,
-		})
-	}
-	// Check for errors from iterating over rows.
-	if err := freqs.Err(); err != nil {
-		return nil, err
+// calculateUnixRangeOfYear returns the first and last second of year in loc,
+// which defaults to UTC when nil
+func calculateUnixRangeOfYear(year int, loc *time.Location) (int64, int64) {
+	if loc == nil {
+		loc = time.UTC
 	}
+	begin := time.Date(year, 1, 1, 0, 0, 0, 0, loc).Unix()
+	end := time.Date(year+1, 1, 1, 0, 0, 0, 0, loc).Unix() - 1
 
-	return itemFreqs, nil
+	return begin, end
 }
 
-func getCountForYear(db *sql.DB, year int) (int, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-
-	count, err := db.Query(fmt.Sprintf(`
-	SELECT COUNT(*)
-	FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d;
-	`, begin, end))
-	if err != nil {
-		return 0, err
-	}
-	defer count.Close()
-
-	var sum int
-	for count.Next() {
-		if err := count.Scan(&sum); err != nil {
-			return 0, err
-		}
-	}
-	// Check for errors from iterating over rows.
-	if err := count.Err(); err != nil {
-		return 0, err
-	}
-
-	return sum, nil
+func GetItemsFromYear(db *sql.DB, year int, loc *time.Location) ([]Result, error) {
+	return GetItemsFromYearContext(context.Background(), db, year, loc)
 }
 
-func getMostCommonChannelForYear(db *sql.DB, year int) ([]ChannelFreq, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-
-	freqs, err := db.Query(fmt.Sprintf(`
-	SELECT "channel", COUNT(*) AS FREQ
-	FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d AND "channel" != ""
-	GROUP BY "channel"
-	ORDER BY COUNT(*) DESC
-	LIMIT 10;
-	`, begin, end))
-	if err != nil {
-		return nil, err
-	}
-	defer freqs.Close()
+// GetItemsFromYearContext is GetItemsFromYear, stopped when ctx is done
+func GetItemsFromYearContext(ctx context.Context, db *sql.DB, year int, loc *time.Location) ([]Result, error) {
+	begin, end := calculateUnixRangeOfYear(year, loc)
 
-	var channelFreqs []ChannelFreq
-	for freqs.Next() {
-		var freqTotal int
-		var channel string
-		if err := freqs.Scan(&channel, &freqTotal); err != nil {
-			return nil, err
-		}
-		channel, _ = url.QueryUnescape(channel)
-		channelFreqs = append(channelFreqs, ChannelFreq{
-			Name:  channel,
-			Count: freqTotal,
-		})
-	}
-	// Check for errors from iterating over rows.
-	if err := freqs.Err(); err != nil {
-		return nil, err
-	}
-
-	return channelFreqs, nil
+	return GetItemsContext(ctx, db, Query{Begin: begin, End: end + 1})
 }
 
-func getYoutubeForYear(db *sql.DB, year int) (int, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-
-	count, err := db.Query(fmt.Sprintf(`
-	SELECT COUNT(*)
-	FROM "items"
-	WHERE "unixtime" > %d AND "unixtime" < %d AND "channel" != "";
-	`, begin, end))
-	if err != nil {
-		return 0, err
-	}
-	defer count.Close()
-
-	var sum int
-	for count.Next() {
-		if err := count.Scan(&sum); err != nil {
-			return 0, err
-		}
-	}
-	// Check for errors from iterating over rows.
-	if err := count.Err(); err != nil {
-		return 0, err
-	}
-
-	return sum, nil
+// GetItemsFromUnixtime returns the items from begin to end, inclusive
+func GetItemsFromUnixtime(db *sql.DB, begin, end int64) ([]Result, error) {
+	return GetItemsFromUnixtimeContext(context.Background(), db, begin, end)
 }
 
-func getAllLocationsForYear(db *sql.DB, year int) ([]Location, error) {
-	begin, end := calculateUnixRangeOfYear(year)
-	rows, err := db.Query(fmt.Sprintf(`
-	SELECT * FROM "locationhistory"
-	WHERE "unixtime" > %d AND "unixtime" < %d;
-	`, begin, end))
-	if err != nil {
-		return nil, err
-	}
-
-	results, err := parseLocationRows(rows)
-	if err != nil {
-		return nil, err
-	}
-
-	return results, nil
+// GetItemsFromUnixtimeContext is GetItemsFromUnixtime, stopped when ctx is done
+func GetItemsFromUnixtimeContext(ctx context.Context, db *sql.DB, begin, end int64) ([]Result, error) {
+	return GetItemsContext(ctx, db, Query{Begin: begin, End: end + 1})
 }
 
-func GetSummaryofYear(db *sql.DB, year int) (*YearlySummary, error) {
-
-	monthly, err := constructMonthlySummary(db, year)
-	if err != nil {
-		return nil, err
-	}
-	common, err := getMostCommonForYear(db, year)
-	if err != nil {
-		return nil, err
-	}
-	channelCommon, err := getMostCommonChannelForYear(db, year)
-	if err != nil {
-		return nil, err
-	}
-	total, err := getCountForYear(db, year)
-	if err != nil {
-		return nil, err
-	}
-	youtubeTotal, err := getYoutubeForYear(db, year)
-	if err != nil {
-		return nil, err
-	}
-	locationData, err := getAllLocationsForYear(db, year)
-	if err != nil {
-		return nil, err
-	}
-
-	yearlySum := YearlySummary{
-		Year:          year,
-		Monthly:       monthly,
-		MostCommon:    common,
-		ChannelCommon: channelCommon,
-		Total:         total,
-		YoutubeTotal:  youtubeTotal,
-		LocationData:  locationData,
-	}
-
-	return &yearlySum, nil
+func getAllLocationsForYear(ctx context.Context, db *sql.DB, year int, loc *time.Location) ([]Location, error) {
+	begin, end := calculateUnixRangeOfYear(year, loc)
+	return queryLocations(ctx, db, `
+	WHERE "unixtime" >= ? AND "unixtime" <= ?
+	ORDER BY "unixtime" ASC, "latitude" ASC, "longitude" ASC`, begin, end)
 }
 
-func getMostCommonItem(db *sql.DB) ([]ItemFreq, error) {
-	freqs, err := db.Query(`
-	SELECT "item", COUNT(*) AS FREQ
-	FROM "items"
-	GROUP BY "item"
-	ORDER BY COUNT(*) DESC
-	LIMIT 10;
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer freqs.Close()
-
-	var itemFreqs []ItemFreq
-	for freqs.Next() {
-		var freqTotal int
-		var item string
-		if err := freqs.Scan(&item, &freqTotal); err != nil {
-			return nil, err
-		}
-		item, _ = url.QueryUnescape(item)
-		itemFreqs = append(itemFreqs, ItemFreq{
-			Name:  item,
-			Count: freqTotal,
-		})
-	}
-	// Check for errors from iterating over rows.
-	if err := freqs.Err(); err != nil {
-		return nil, err
-	}
-
-	return itemFreqs, nil
+func GetSummaryofYear(db *sql.DB, year int, loc *time.Location) (*YearlySummary, error) {
+	return GetSummaryofYearContext(context.Background(), db, year, loc)
 }
 
-func getCountTotal(db *sql.DB) (int, error) {
-
-	count, err := db.Query(`
-	SELECT COUNT(*)
-	FROM "items";
-	`)
-	if err != nil {
-		return 0, err
-	}
-	defer count.Close()
-
-	var sum int
-	for count.Next() {
-		if err := count.Scan(&sum); err != nil {
-			return 0, err
-		}
-	}
-	// Check for errors from iterating over rows.
-	if err := count.Err(); err != nil {
-		return 0, err
-	}
-
-	return sum, nil
+// GetSummaryofYearContext is GetSummaryofYear, stopped when ctx is done
+func GetSummaryofYearContext(ctx context.Context, db *sql.DB, year int, loc *time.Location) (*YearlySummary, error) {
+	return GetSummaryofYearWithOptions(ctx, db, year, loc, SummaryOptions{Locations: true})
 }
 
-func getYoutubeTotal(db *sql.DB) (int, error) {
-
-	count, err := db.Query(`
-	SELECT COUNT(*)
-	FROM "items"
-	WHERE "channel" != "";
-	`)
-	if err != nil {
-		return 0, err
-	}
-	defer count.Close()
-
-	var sum int
-	for count.Next() {
-		if err := count.Scan(&sum); err != nil {
-			return 0, err
-		}
-	}
-	// Check for errors from iterating over rows.
-	if err := count.Err(); err != nil {
-		return 0, err
-	}
-
-	return sum, nil
+func getMostCommonItem(ctx context.Context, db queryer) ([]ItemFreq, error) {
+	top, err := topN(ctx, db, GroupByItem, summaryTop, ItemFilter{})
+	return itemFreqs(top), err
 }
 
-func getMostCommonChannel(db *sql.DB) ([]ChannelFreq, error) {
-	freqs, err := db.Query(`
-	SELECT "channel", COUNT(*) AS FREQ
-	FROM "items"
-	WHERE "channel" != ""
-	GROUP BY "channel"
-	ORDER BY COUNT(*) DESC
-	LIMIT 10;
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer freqs.Close()
-
-	var channelFreqs []ChannelFreq
-	for freqs.Next() {
-		var freqTotal int
-		var channel string
-		if err := freqs.Scan(&channel, &freqTotal); err != nil {
-			return nil, err
-		}
-		channel, _ = url.QueryUnescape(channel)
-		channelFreqs = append(channelFreqs, ChannelFreq{
-			Name:  channel,
-			Count: freqTotal,
-		})
-	}
-	// Check for errors from iterating over rows.
-	if err := freqs.Err(); err != nil {
-		return nil, err
-	}
-
-	return channelFreqs, nil
+func getMostCommonChannel(ctx context.Context, db queryer) ([]ChannelFreq, error) {
+	top, err := topN(ctx, db, GroupByChannel, summaryTop, ItemFilter{})
+	return channelFreqs(top), err
 }
 
-// type TotalSummary struct {
-// 	MostCommon    []ItemFreq      `json:"mostcommon"`
-// 	YoutubeTotal  int             `json:"youtubetotal"`
-// 	ChannelCommon []ChannelFreq   `json:"channelcommon"`
-// 	Total         int             `json:"total"`
-// 	Yearly        []YearlySummary `json:"yearly"`
-// }
-
-func GetTotalSummary(db *sql.DB) (*TotalSummary, error) {
-
-	years, err := GetYears(db)
-	if err != nil {
-		return nil, err
-	}
-
-	var yearSums []YearlySummary
-	for _, year := range years {
-		yearSum, err := GetSummaryofYear(db, year)
-		if err != nil {
-			return nil, err
-		}
-		yearSums = append(yearSums, *yearSum)
-	}
-
-	mostCommon, err := getMostCommonItem(db)
-	if err != nil {
-		return nil, err
-	}
-
-	total, err := getCountTotal(db)
-	if err != nil {
-		return nil, err
-	}
-
-	youtubeTotal, err := getYoutubeTotal(db)
-	if err != nil {
-		return nil, err
-	}
-
-	channelCommon, err := getMostCommonChannel(db)
-	if err != nil {
-		return nil, err
-	}
+func GetTotalSummary(db *sql.DB, loc *time.Location) (*TotalSummary, error) {
+	return GetTotalSummaryContext(context.Background(), db, loc)
+}
 
-	locationData, err := GetAllLocations(db)
-	if err != nil {
-		return nil, err
-	}
+// GetTotalSummaryContext is GetTotalSummary, stopped when ctx is done
+func GetTotalSummaryContext(ctx context.Context, db *sql.DB, loc *time.Location) (*TotalSummary, error) {
+	return GetTotalSummaryWithOptions(ctx, db, loc, SummaryOptions{Locations: true})
+}
 
-	totalSum := TotalSummary{
-		MostCommon:    mostCommon,
-		YoutubeTotal:  youtubeTotal,
-		ChannelCommon: channelCommon,
-		Total:         total,
-		Yearly:        yearSums,
-		LocationData:  locationData,
-	}
+// GetYears returns every year between the first and last item, as seen in loc
+func GetYears(db *sql.DB, loc *time.Location) ([]int, error) {
+	return GetYearsContext(context.Background(), db, loc)
+}
 
-	return &totalSum, nil
+// GetYearsContext is GetYears, stopped when ctx is done
+func GetYearsContext(ctx context.Context, db *sql.DB, loc *time.Location) ([]int, error) {
+	return getYears(ctx, db, loc)
 }
 
-func GetYears(db *sql.DB) ([]int, error) {
-	rows, err := db.Query(`
+func getYears(ctx context.Context, db queryer, loc *time.Location) ([]int, error) {
+	rows, err := db.QueryContext(ctx, `
 	SELECT MIN("unixtime"), MAX("unixtime") FROM "items";
 	`)
 	if err != nil {
 		return nil, err
 	}
-	var min, max int64
+	defer rows.Close()
+	var min, max sql.NullInt64
 
 	for rows.Next() {
 		if err := rows.Scan(&min, &max); err != nil {
@@ -707,9 +359,17 @@ func GetYears(db *sql.DB) ([]int, error) {
 		return nil, err
 	}
 
-	begin := time.Unix(min, 0).Year()
-	end := time.Unix(max, 0).Year()
 	years := []int{}
+	// An empty table has no years
+	if !min.Valid || !max.Valid {
+		return years, nil
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+	begin := time.Unix(min.Int64, 0).In(loc).Year()
+	end := time.Unix(max.Int64, 0).In(loc).Year()
 
 	for i := begin; i <= end; i++ {
 		years = append(years, i)
@@ -718,23 +378,26 @@ func GetYears(db *sql.DB) ([]int, error) {
 	return years, nil
 }
 
-func SearchItems(db *sql.DB, searchString string) ([]Result, error) {
-	rows, err := db.Query(`
-	SELECT * FROM "items"
-	WHERE "item" LIKE '%` + searchString + `%' ORDER BY "unixtime" ASC;
-	`)
-	if err != nil {
-		return nil, err
-	}
+// likePattern matches s anywhere in a LIKE ? ESCAPE '\' comparison, escaping
+// wildcards so s only matches literally
+func likePattern(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s) + "%"
+}
 
-	results, err := parseRows(rows)
-	if err != nil {
-		return nil, err
-	}
+// SearchItems returns the items containing searchString literally, matched
+// with LIKE in the order GetItems uses. For results ranked by relevance with
+// FTS5, use Search.
+func SearchItems(db *sql.DB, searchString string) ([]Result, error) {
+	return SearchItemsContext(context.Background(), db, searchString)
+}
 
-	return results, nil
+// SearchItemsContext is SearchItems, stopped when ctx is done
+func SearchItemsContext(ctx context.Context, db *sql.DB, searchString string) ([]Result, error) {
+	return GetItemsContext(ctx, db, Query{Text: searchString})
 }
 
+// Deprecated: BEGIN on a pooled *sql.DB may run on a different connection
+// than the statements that follow it. Use a Writer instead.
 func BeginTransaction(db *sql.DB) error {
 	_, err := db.Exec(`
 	BEGIN TRANSACTION;
@@ -745,6 +408,7 @@ func BeginTransaction(db *sql.DB) error {
 	return nil
 }
 
+// Deprecated: use a Writer instead.
 func CommitTransaction(db *sql.DB) error {
 	_, err := db.Exec(`
 	COMMIT TRANSACTION;
@@ -1,8 +1,15 @@
 package ParseTakeout
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreateDB(t *testing.T) {
@@ -70,13 +77,13 @@ func TestGetItemsFromYear(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	years, err := GetYears(db)
+	years, err := GetYears(db, time.UTC)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	for _, year := range years {
-		results, err := GetItemsFromYear(db, year)
+		results, err := GetItemsFromYear(db, year, time.UTC)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -103,13 +110,34 @@ func TestGetItems(t *testing.T) {
 
 }
 
+func TestGetItemsFromUnixtimeBounds(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	// Items at begin and end are both included
+	results, err := GetItemsFromUnixtime(db, 100, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected the 3 items from 100 to 200, got %+v", results)
+	}
+	results, err = GetItemsFromUnixtime(db, 300, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Item != "cats" {
+		t.Fatalf("Expected the item at 300, got %+v", results)
+	}
+}
+
 func TestGetYears(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	years, err := GetYears(db)
+	years, err := GetYears(db, time.UTC)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,114 +162,353 @@ func TestSearchItems(t *testing.T) {
 	fmt.Println(fmt.Sprintf("Search for '%s' returned %d results", searchString, len(results)))
 }
 
-func TestConstructMonthlySummary(t *testing.T) {
+func TestGetSummaryofYear(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	monSum, err := constructMonthlySummary(db, 2017)
+	summary, err := GetSummaryofYear(db, 2017, time.UTC)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	fmt.Println(monSum)
+	fmt.Println(summary)
 }
 
-func TestGetMostCommonForYear(t *testing.T) {
+func TestGetTotalSummary(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	common, err := getMostCommonForYear(db, 2017)
+	summary, err := GetTotalSummary(db, time.UTC)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	fmt.Println(common)
+	fmt.Println(summary)
 }
 
-func TestGetYoutubeForYear(t *testing.T) {
+func TestGetAllLocationsForYear(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	count, err := getYoutubeForYear(db, 2017)
+	locs, err := getAllLocationsForYear(context.Background(), db, 2017, time.UTC)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	fmt.Println(fmt.Sprintf("Youtube: %d", count))
+	fmt.Println(locs)
 }
 
-func TestGetMostCommonChannelForYear(t *testing.T) {
+func TestGetItemsByProduct(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	common, err := getMostCommonChannelForYear(db, 2017)
+	res := Result{
+		Title:    "test",
+		Action:   "test",
+		Item:     "product test",
+		Date:     "test",
+		UnixTime: 1234,
+		Products: []string{"Test Product"},
+		Details:  []string{"From a test"},
+		Locations: []ActivityLocation{{
+			Name:      "Somewhere",
+			Latitude:  40.5,
+			Longitude: -74.5,
+		}},
+	}
+	err = InsertItem(db, res)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer DeleteItem(db, res)
 
-	fmt.Println(common)
+	results, err := GetItemsByProduct(db, "Test Product")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if len(results[0].Details) != 1 || len(results[0].Locations) != 1 {
+		t.Fatalf("Expected details and location, got %v", results[0])
+	}
+
+	results, err = GetItemsInArea(db, 40, -75, 41, -74)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result in area, got %d", len(results))
+	}
 }
 
-func TestGetCountForYear(t *testing.T) {
+func TestGetItemsFromYearLocation(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	count, err := getCountForYear(db, 2017)
+	est := time.FixedZone("EST", -5*60*60)
+	newYearsEve := time.Date(2019, 12, 31, 23, 30, 0, 0, est)
+	res := Result{
+		Title:     "test",
+		Action:    "test",
+		Item:      "new years eve",
+		Date:      "2019-12-31T23:30:00",
+		UnixTime:  newYearsEve.Unix(),
+		UTCOffset: -5 * 60 * 60,
+	}
+	err = InsertItem(db, res)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer DeleteItem(db, res)
 
-	fmt.Println(count)
+	results, err := GetItemsFromYear(db, 2019, est)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range results {
+		if r.Item == res.Item {
+			found = true
+			if r.UTCOffset != res.UTCOffset {
+				t.Fatalf("Expected offset %d, got %d", res.UTCOffset, r.UTCOffset)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Expected item in 2019 when bucketed in EST")
+	}
+
+	results, err = GetItemsFromYear(db, 2019, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Item == res.Item {
+			t.Fatal("Expected item outside 2019 when bucketed in UTC")
+		}
+	}
 }
 
-func TestGetSummaryofYear(t *testing.T) {
-	db, err := OpenDB(testHome + "takeout.db")
+func TestUnescapeLegacyText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	summary, err := GetSummaryofYear(db, 2017)
+	dbPath := filepath.Join(dir, "legacy.db")
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`
+	CREATE TABLE "items" (
+		"title"	TEXT,
+		"action"	TEXT,
+		"item"	TEXT,
+		"channel"	TEXT,
+		"date"	TEXT,
+		"unixtime"	INTEGER,
+		PRIMARY KEY("action","unixtime","item")
+	);
+	INSERT INTO "items" VALUES ("Search", "Searched+for", "100%25+%22quoted%22+%26+more", "", "2019-01-01T00%3A00%3A00", 1546300800);
+	`)
 	if err != nil {
 		t.Fatal(err)
 	}
+	legacy.Close()
 
-	fmt.Println(summary)
-}
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 
-func TestGetTotalSummary(t *testing.T) {
-	db, err := OpenDB(testHome + "takeout.db")
+	results, err := GetAllItems(db)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(results))
+	}
+	res := results[0]
+	if res.Action != "Searched for" || res.Item != `100% "quoted" & more` || res.Date != "2019-01-01T00:00:00" {
+		t.Fatalf("Expected unescaped item, got %v", res)
+	}
 
-	summary, err := GetTotalSummary(db)
+	// Plain text stored after the migration is left alone
+	res.Item = "50%25 off"
+	res.UnixTime++
+	err = InsertItem(db, res)
 	if err != nil {
 		t.Fatal(err)
 	}
+	db.Close()
 
-	fmt.Println(summary)
+	db, err = OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = SearchItems(db, "%25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Item != "50%25 off" {
+		t.Fatalf("Expected the plain text item, got %v", results)
+	}
 }
 
-func TestGetAllLocationsForYear(t *testing.T) {
+func TestSearchItemsQuoting(t *testing.T) {
 	db, err := OpenDB(testHome + "takeout.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	locs, err := getAllLocationsForYear(db, 2017)
+	results, err := SearchItems(db, `' OR 1=1; --`)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(results) != 0 {
+		t.Fatalf("Expected no results, got %d", len(results))
+	}
+}
 
-	fmt.Println(locs)
+func TestMigrateSchemaV0(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	schema, err := ioutil.ReadFile(testHome + "schema-v0.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "v0.db")
+	v0, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v0.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0.Close()
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("Expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(results))
+	}
+	items := map[string]Result{}
+	for _, res := range results {
+		items[res.Item] = res
+	}
+	res, ok := items["Gophers & Goroutines"]
+	if !ok || res.Channel != "Go Channel" || res.Date != "2019-03-02T10:15:00" {
+		t.Fatalf("Expected the unescaped video, got %v", results)
+	}
+	if _, ok := items[`sqlite "row values"`]; !ok {
+		t.Fatalf("Expected the unescaped search, got %v", results)
+	}
+	if _, ok := items["Café near me"]; !ok {
+		t.Fatalf("Expected the unescaped place, got %v", results)
+	}
+
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 2 {
+		t.Fatalf("Expected 2 locations, got %d", len(locations))
+	}
+
+	// New columns and tables are usable after the upgrade
+	res.UnixTime++
+	res.URL = "https://www.youtube.com/watch?v=abc"
+	res.Products = []string{"YouTube"}
+	err = InsertItem(db, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Opening again applies nothing
+	db, err = OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	err = db.QueryRow(`SELECT COUNT(*) FROM "schema_version";`).Scan(&applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("Expected %d applied migrations, got %d", len(migrations), applied)
+	}
+	results, err = GetItemsByProduct(db, "YouTube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].URL != "https://www.youtube.com/watch?v=abc" {
+		t.Fatalf("Expected the new item, got %v", results)
+	}
+}
+
+func TestItemDetailIndexes(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	for _, table := range itemDetailTables {
+		rows, err := db.Query(`
+		EXPLAIN QUERY PLAN SELECT * FROM "`+table+`"
+		WHERE "action" = ? AND "unixtime" = ? AND "item" = ?;
+		`, "Watched", 300, "cats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := ""
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan += detail + "\n"
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if !strings.Contains(plan, `USING INDEX `+table+`_key`) {
+			t.Errorf("Expected %s to be looked up by its key index, got plan:\n%s", table, plan)
+		}
+	}
 }
@@ -0,0 +1,130 @@
+package ParseTakeout
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// activityJSON is one entry of the JSON flavour of a My Activity export
+type activityJSON struct {
+	Header        string             `json:"header"`
+	Title         string             `json:"title"`
+	TitleURL      string             `json:"titleUrl"`
+	Subtitles     []activityJSONLink `json:"subtitles"`
+	Time          string             `json:"time"`
+	Products      []string           `json:"products"`
+	Details       []activityJSONLink `json:"details"`
+	LocationInfos []activityJSONLink `json:"locationInfos"`
+}
+
+type activityJSONLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func ParseActivityJSON(filePath string) ([]Result, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results := []Result{}
+	err = ParseActivityJSONReader(f, func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ParseActivityJSONReader parses a JSON My Activity export, detecting its locale
+func ParseActivityJSONReader(r io.Reader, fn func(Result) error) error {
+	p := ActivityJSONParser{}
+	return p.Parse(r, fn)
+}
+
+type ActivityJSONParser struct {
+	// Locale of the titles. When nil it is detected from the first action a
+	// registered locale recognises.
+	Locale *Locale
+}
+
+// Parse decodes the activity array one entry at a time and calls fn with each
+// Result. Returning an error from fn stops parsing and that error is returned.
+func (p ActivityJSONParser) Parse(r io.Reader, fn func(Result) error) error {
+	dec := json.NewDecoder(r)
+	locale := p.Locale
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("Expected a JSON array of activities")
+	}
+
+	for dec.More() {
+		var a activityJSON
+		if err := dec.Decode(&a); err != nil {
+			return err
+		}
+
+		line := []segment{{text: a.Title}}
+		if locale == nil {
+			locale = detectLocale(line)
+		}
+		l := locale
+		if l == nil {
+			l = English()
+		}
+
+		if err := fn(a.result(l)); err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+func (a activityJSON) result(l *Locale) Result {
+	res := Result{
+		Title:    a.Header,
+		URL:      a.TitleURL,
+		Products: a.Products,
+	}
+
+	// The title holds both the action and the item, e.g. "Watched Some Video"
+	res.parseActivity([]segment{{text: a.Title}}, l)
+	if res.Action == "" {
+		res.Item = strings.TrimSpace(a.Title)
+	}
+
+	if res.Action == "Watched" && res.Title != "Google News" && len(a.Subtitles) > 0 {
+		res.Channel = a.Subtitles[0].Name
+		res.ChannelURL = a.Subtitles[0].URL
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, a.Time)
+	if err == nil {
+		res.Date = formatDate(t)
+		res.UnixTime = t.Unix()
+		_, res.UTCOffset = t.Zone()
+	}
+
+	for _, detail := range a.Details {
+		res.addCaptionLine("Details", detail.Name, detail.URL)
+	}
+	for _, info := range a.LocationInfos {
+		res.addCaptionLine("Locations", info.Name, info.URL)
+	}
+
+	return res
+}
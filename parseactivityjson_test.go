@@ -0,0 +1,43 @@
+package ParseTakeout
+
+import (
+	"testing"
+)
+
+func TestParseActivityJSON(t *testing.T) {
+	results, err := ParseActivityJSON(testHome + "My-Activity-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	for _, res := range results {
+		if err := res.Validate(); err != nil {
+			t.Fatalf("Invalid result %v: %s", res, err)
+		}
+	}
+
+	watched := results[1]
+	if watched.Action != "Watched" || watched.Item != "A Video" {
+		t.Fatalf("Unexpected result %v", watched)
+	}
+	if watched.Channel != "A Channel" || watched.ChannelURL != "https://www.youtube.com/channel/xyz" {
+		t.Fatalf("Unexpected channel %s %s", watched.Channel, watched.ChannelURL)
+	}
+	if len(watched.Details) != 1 || watched.Details[0] != "From Google Ads" {
+		t.Fatalf("Unexpected details %v", watched.Details)
+	}
+
+	searched := results[2]
+	if searched.Action != "Searched for" || searched.Item != "golang" {
+		t.Fatalf("Unexpected result %v", searched)
+	}
+	if len(searched.Locations) != 1 || searched.Locations[0].Latitude != 40.7128 {
+		t.Fatalf("Unexpected locations %v", searched.Locations)
+	}
+	if searched.Date != "2019-10-29T15:52:56" || searched.UnixTime != 1572364376 {
+		t.Fatalf("Unexpected date %s %d", searched.Date, searched.UnixTime)
+	}
+}
@@ -0,0 +1,48 @@
+package ParseTakeout
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type browserHistory struct {
+	BrowserHistory []browserHistoryEntry `json:"Browser History"`
+}
+
+type browserHistoryEntry struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	TimeUsec int64  `json:"time_usec"`
+}
+
+// ParseBrowserHistoryReader parses Chrome's BrowserHistory.json into Results
+// with the "Visited" action
+func ParseBrowserHistoryReader(r io.Reader, fn func(Result) error) error {
+	var history browserHistory
+	err := json.NewDecoder(r).Decode(&history)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range history.BrowserHistory {
+		t := time.Unix(0, entry.TimeUsec*int64(time.Microsecond)).UTC()
+		item := entry.Title
+		if item == "" {
+			item = entry.URL
+		}
+		err := fn(Result{
+			Title:    "Chrome",
+			Action:   "Visited",
+			Item:     item,
+			URL:      entry.URL,
+			Date:     formatDate(t),
+			UnixTime: t.Unix(),
+			Products: []string{"Chrome"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
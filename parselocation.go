@@ -1,11 +1,15 @@
 package ParseTakeout
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strconv"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -18,16 +22,73 @@ type Location struct {
 	Unixtime  int64 `json:"unixtime"`
 	Latitude  int64 `json:"latitude"`
 	Longitude int64 `json:"longitude"`
+	// UnixTimeMs is the same instant as Unixtime in milliseconds
+	UnixTimeMs int64 `json:"unixtimems,omitempty"`
+	// Accuracy is the radius in meters the point is accurate to, 0 if unknown
+	Accuracy         int                `json:"accuracy,omitempty"`
+	Altitude         int                `json:"altitude,omitempty"`
+	VerticalAccuracy int                `json:"verticalaccuracy,omitempty"`
+	Velocity         int                `json:"velocity,omitempty"`
+	Heading          int                `json:"heading,omitempty"`
+	Source           string             `json:"source,omitempty"`
+	DeviceTag        int64              `json:"devicetag,omitempty"`
+	Activities       []LocationActivity `json:"activities,omitempty"`
+}
+
+// locationKey is what makes a point unique, as in "locationhistory_key"
+type locationKey struct {
+	unixtime  int64
+	latitude  int64
+	longitude int64
+}
+
+func (l Location) key() locationKey {
+	return locationKey{
+		unixtime:  l.Unixtime,
+		latitude:  l.Latitude,
+		longitude: l.Longitude,
+	}
+}
+
+// LocationActivity is one guess at what the device was doing around a
+// location, e.g. WALKING or IN_VEHICLE, with a confidence from 0 to 100
+type LocationActivity struct {
+	Unixtime   int64  `json:"unixtime"`
+	Type       string `json:"type"`
+	Confidence int    `json:"confidence"`
 }
 
 type DataInput struct {
 	Locations []LocationInput `json:"locations"`
 }
 
+// LocationInput is a record of either Location History.json, with its
+// timestampMs in milliseconds, or the newer Records.json, with an ISO 8601
+// timestamp
 type LocationInput struct {
-	Timestamp string `json:"timestampMs"`
-	Latitude  int64  `json:"latitudeE7"`
-	Longitude int64  `json:"longitudeE7"`
+	Timestamp        string          `json:"timestampMs"`
+	Time             string          `json:"timestamp"`
+	Latitude         int64           `json:"latitudeE7"`
+	Longitude        int64           `json:"longitudeE7"`
+	Accuracy         int             `json:"accuracy"`
+	Altitude         int             `json:"altitude"`
+	VerticalAccuracy int             `json:"verticalAccuracy"`
+	Velocity         int             `json:"velocity"`
+	Heading          int             `json:"heading"`
+	Source           string          `json:"source"`
+	DeviceTag        int64           `json:"deviceTag"`
+	Activity         []ActivityInput `json:"activity"`
+}
+
+type ActivityInput struct {
+	Timestamp string              `json:"timestampMs"`
+	Time      string              `json:"timestamp"`
+	Activity  []ActivityTypeInput `json:"activity"`
+}
+
+type ActivityTypeInput struct {
+	Type       string `json:"type"`
+	Confidence int    `json:"confidence"`
 }
 
 func (l Location) String() string {
@@ -35,7 +96,8 @@ func (l Location) String() string {
 Unixtime: %d
 Lat: %d
 Lon: %d
-*****`, l.Unixtime, l.Latitude, l.Longitude)
+Accuracy: %d
+*****`, l.Unixtime, l.Latitude, l.Longitude, l.Accuracy)
 	return s
 }
 
@@ -47,41 +109,151 @@ func LoadJSON(filePath string) (*DataInput, error) {
 
 	var data DataInput
 
-	json.Unmarshal(bytes, &data)
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		return nil, err
+	}
 
 	return &data, nil
 }
 
-func FormatInput(loc LocationInput) Location {
-	t, _ := strconv.Atoi(loc.Timestamp)
-	return Location{
-		Unixtime:  int64(t / 1000),
-		Latitude:  loc.Latitude,
-		Longitude: loc.Longitude,
+func LoadJSONReader(r io.Reader) (*DataInput, error) {
+	var data DataInput
+
+	err := json.NewDecoder(r).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// parseLocationTimestamp returns the milliseconds since the epoch of a
+// timestampMs or ISO 8601 timestamp, whichever is set
+func parseLocationTimestamp(ms, iso string) (int64, error) {
+	if ms != "" {
+		t, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid timestampMs %q", ms)
+		}
+		return t, nil
 	}
+	if iso != "" {
+		t, err := time.Parse(time.RFC3339Nano, iso)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid timestamp %q", iso)
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	return 0, errors.New("Missing timestamp")
+}
+
+// unixSeconds floors milliseconds to seconds, so times before the epoch
+// stay in the second they happened in
+func unixSeconds(ms int64) int64 {
+	if ms < 0 && ms%1000 != 0 {
+		return ms/1000 - 1
+	}
+	return ms / 1000
+}
+
+func FormatInput(loc LocationInput) (Location, error) {
+	t, err := parseLocationTimestamp(loc.Timestamp, loc.Time)
+	if err != nil {
+		return Location{}, err
+	}
+	res := Location{
+		Unixtime:         unixSeconds(t),
+		UnixTimeMs:       t,
+		Latitude:         loc.Latitude,
+		Longitude:        loc.Longitude,
+		Accuracy:         loc.Accuracy,
+		Altitude:         loc.Altitude,
+		VerticalAccuracy: loc.VerticalAccuracy,
+		Velocity:         loc.Velocity,
+		Heading:          loc.Heading,
+		Source:           loc.Source,
+		DeviceTag:        loc.DeviceTag,
+	}
+	for _, activity := range loc.Activity {
+		at, err := parseLocationTimestamp(activity.Timestamp, activity.Time)
+		if err != nil {
+			return Location{}, fmt.Errorf("Activity: %v", err)
+		}
+		for _, guess := range activity.Activity {
+			res.Activities = append(res.Activities, LocationActivity{
+				Unixtime:   unixSeconds(at),
+				Type:       guess.Type,
+				Confidence: guess.Confidence,
+			})
+		}
+	}
+	return res, nil
 }
 
 func InsertLocation(db *sql.DB, loc Location) error {
-	_, err := db.Exec(fmt.Sprintf(`
-	INSERT INTO "locationhistory" ("unixtime", "latitude", "longitude")
-	VALUES ("%d", "%d", "%d");
-	`, loc.Unixtime, loc.Latitude, loc.Longitude))
+	return InsertLocationContext(context.Background(), db, loc)
+}
+
+// InsertLocationContext is InsertLocation, stopped when ctx is done
+func InsertLocationContext(ctx context.Context, db *sql.DB, loc Location) error {
+	return insertLocation(ctx, db, loc, sql.NullInt64{})
+}
+
+func insertLocation(ctx context.Context, db execer, loc Location, importID sql.NullInt64) error {
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO "locationhistory" ("unixtime", "latitude", "longitude", "unixtimems", "accuracy", "altitude", "verticalaccuracy", "velocity", "heading", "source", "devicetag", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, loc.Unixtime, loc.Latitude, loc.Longitude, loc.UnixTimeMs, loc.Accuracy, loc.Altitude, loc.VerticalAccuracy, loc.Velocity, loc.Heading, loc.Source, loc.DeviceTag, loc.Hash(), importID)
 	if err != nil {
 		return err
 	}
+	return insertLocationActivity(ctx, db, loc)
+}
+
+func insertLocationActivity(ctx context.Context, db execer, loc Location) error {
+	for _, activity := range loc.Activities {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO "locationactivity" ("locationtime", "locationlatitude", "locationlongitude", "unixtime", "type", "confidence")
+		VALUES (?, ?, ?, ?, ?, ?);
+		`, loc.Unixtime, loc.Latitude, loc.Longitude, activity.Unixtime, activity.Type, activity.Confidence)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// DeleteLocation deletes the point with the same time and coordinates as loc,
+// along with its activities
 func DeleteLocation(db *sql.DB, loc Location) error {
+	return DeleteLocationContext(context.Background(), db, loc)
+}
 
-	_, err := db.Exec(fmt.Sprintf(`
+// DeleteLocationContext is DeleteLocation, stopped when ctx is done
+func DeleteLocationContext(ctx context.Context, db *sql.DB, loc Location) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
 	DELETE FROM "locationhistory" WHERE
-	"unixtime" = "%d";
-	`, loc.Unixtime))
+	"unixtime" = ? AND "latitude" = ? AND "longitude" = ?;
+	`, loc.Unixtime, loc.Latitude, loc.Longitude)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+	_, err = tx.ExecContext(ctx, `
+	DELETE FROM "locationactivity" WHERE
+	"locationtime" = ? AND "locationlatitude" = ? AND "locationlongitude" = ?;
+	`, loc.Unixtime, loc.Latitude, loc.Longitude)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func parseLocationRows(rows *sql.Rows) ([]Location, error) {
@@ -89,29 +261,40 @@ func parseLocationRows(rows *sql.Rows) ([]Location, error) {
 
 	results := []Location{}
 	for rows.Next() {
-		var t int64
-		var lat int64
-		var lon int64
-		if err := rows.Scan(&t, &lat, &lon); err != nil {
+		// Legacy points may have NULL coordinates, read as 0
+		var t, lat, lon sql.NullInt64
+		var ms, accuracy, altitude, verticalAccuracy, velocity, heading, deviceTag sql.NullInt64
+		var source sql.NullString
+		if err := rows.Scan(&t, &lat, &lon, &ms, &accuracy, &altitude, &verticalAccuracy, &velocity, &heading, &source, &deviceTag); err != nil {
 			return nil, err
 		}
 		results = append(results, Location{
-			Unixtime:  t,
-			Latitude:  lat,
-			Longitude: lon,
+			Unixtime:         t.Int64,
+			Latitude:         lat.Int64,
+			Longitude:        lon.Int64,
+			UnixTimeMs:       ms.Int64,
+			Accuracy:         int(accuracy.Int64),
+			Altitude:         int(altitude.Int64),
+			VerticalAccuracy: int(verticalAccuracy.Int64),
+			Velocity:         int(velocity.Int64),
+			Heading:          int(heading.Int64),
+			Source:           source.String,
+			DeviceTag:        deviceTag.Int64,
 		})
-		// Check for errors from iterating over rows.
-		if err := rows.Err(); err != nil {
-			return nil, err
-		}
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 	return results, nil
 }
 
-func GetAllLocations(db *sql.DB) ([]Location, error) {
-	rows, err := db.Query(`
-	SELECT * FROM "locationhistory";
-	`)
+// queryLocations selects the points matching where along with their activities
+func queryLocations(ctx context.Context, db queryer, where string, args ...interface{}) ([]Location, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "unixtime", "latitude", "longitude", "unixtimems", "accuracy", "altitude", "verticalaccuracy", "velocity", "heading", "source", "devicetag"
+	FROM "locationhistory" `+where+`;
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -121,15 +304,121 @@ func GetAllLocations(db *sql.DB) ([]Location, error) {
 		return nil, err
 	}
 
+	err = attachLocationActivity(ctx, db, results, where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// attachLocationActivity fills in the activities of results, which must have
+// been selected from "locationhistory" with the same where clause
+func attachLocationActivity(ctx context.Context, db queryer, results []Location, where string, args ...interface{}) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	index := make(map[locationKey]int, len(results))
+	for i, loc := range results {
+		index[loc.key()] = i
+	}
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT "locationtime", "locationlatitude", "locationlongitude", "unixtime", "type", "confidence" FROM "locationactivity"
+	WHERE ("locationtime", "locationlatitude", "locationlongitude") IN (
+		SELECT "unixtime", "latitude", "longitude" FROM "locationhistory" `+where+`
+	) ORDER BY "locationtime", "locationlatitude", "locationlongitude", "unixtime", "confidence" DESC;
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key locationKey
+		var activity LocationActivity
+		if err := rows.Scan(&key.unixtime, &key.latitude, &key.longitude, &activity.Unixtime, &activity.Type, &activity.Confidence); err != nil {
+			return err
+		}
+		if i, ok := index[key]; ok {
+			results[i].Activities = append(results[i].Activities, activity)
+		}
+	}
+	// Check for errors from iterating over rows.
+	return rows.Err()
+}
+
+func GetAllLocations(db *sql.DB) ([]Location, error) {
+	return GetAllLocationsContext(context.Background(), db)
+}
+
+// GetAllLocationsContext is GetAllLocations, stopped when ctx is done
+func GetAllLocationsContext(ctx context.Context, db *sql.DB) ([]Location, error) {
+	return queryLocations(ctx, db, "")
+}
+
+// GetLocationsWithAccuracy returns the points known to be accurate to within
+// maxAccuracy meters. Points without an accuracy are left out.
+func GetLocationsWithAccuracy(db *sql.DB, maxAccuracy int) ([]Location, error) {
+	return GetLocationsWithAccuracyContext(context.Background(), db, maxAccuracy)
+}
+
+// GetLocationsWithAccuracyContext is GetLocationsWithAccuracy, stopped when ctx is done
+func GetLocationsWithAccuracyContext(ctx context.Context, db *sql.DB, maxAccuracy int) ([]Location, error) {
+	return queryLocations(ctx, db, `
+	WHERE "accuracy" > 0 AND "accuracy" <= ?
+	ORDER BY "unixtime" ASC`, maxAccuracy)
+}
+
+// GetActivityTypeCounts counts how often each activity type was the most
+// confident guess, i.e. how the time was spent moving
+func GetActivityTypeCounts(db *sql.DB) ([]ItemFreq, error) {
+	return GetActivityTypeCountsContext(context.Background(), db)
+}
+
+// GetActivityTypeCountsContext is GetActivityTypeCounts, stopped when ctx is done
+func GetActivityTypeCountsContext(ctx context.Context, db *sql.DB) ([]ItemFreq, error) {
+	// SQLite takes the bare "type" from the row holding MAX("confidence")
+	rows, err := db.QueryContext(ctx, `
+	SELECT "type", COUNT(*) AS "count" FROM (
+		SELECT "type", MAX("confidence") FROM "locationactivity"
+		GROUP BY "locationtime", "locationlatitude", "locationlongitude", "unixtime"
+	) GROUP BY "type" ORDER BY "count" DESC, "type" ASC;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ItemFreq{}
+	for rows.Next() {
+		var freq ItemFreq
+		if err := rows.Scan(&freq.Name, &freq.Count); err != nil {
+			return nil, err
+		}
+		results = append(results, freq)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
 func InsertJSON(db *sql.DB, data Data) error {
+	return InsertJSONContext(context.Background(), db, data)
+}
+
+// InsertJSONContext is InsertJSON, stopped when ctx is done
+func InsertJSONContext(ctx context.Context, db *sql.DB, data Data) error {
+	w := NewWriterContext(ctx, db, 0)
 	for _, loc := range data.Locations {
-		err := InsertLocation(db, loc)
+		_, err := w.UpsertLocation(loc)
 		if err != nil {
+			w.Rollback()
 			return err
 		}
 	}
-	return nil
+	return w.Close()
 }
@@ -2,6 +2,10 @@ package ParseTakeout
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -47,6 +51,58 @@ func TestDeleteLocation(t *testing.T) {
 	}
 }
 
+func TestKeyLocationActivities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "keyed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Put back activities keyed only by time, as stored before
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = execAll(tx, `
+	DROP TABLE "locationactivity";
+	`, `
+	CREATE TABLE "locationactivity" ("locationtime" INTEGER, "unixtime" INTEGER, "type" TEXT, "confidence" INTEGER);
+	`, `
+	INSERT INTO "locationhistory" ("unixtime", "latitude", "longitude") VALUES (100, 1, 1), (100, 2, 2), (200, 3, 3);
+	`, `
+	INSERT INTO "locationactivity" VALUES (100, 99, 'STILL', 50), (300, 299, 'WALKING', 50);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyLocationActivities(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []int{}
+	for _, loc := range locations {
+		counts = append(counts, len(loc.Activities))
+	}
+	// Both points at 100 get the activity, and the one without a point goes
+	if !reflect.DeepEqual(counts, []int{1, 1, 0}) || countRows(t, db, "locationactivity") != 2 {
+		t.Errorf("Unexpected activities after keying %v", locations)
+	}
+}
+
 // func TestInsertJSON(t *testing.T) {
 // 	db, err := OpenDB(testHome + "takeout.db")
 // 	if err != nil {
@@ -77,3 +133,139 @@ func TestGetAllLocations(t *testing.T) {
 
 	fmt.Println(len(results))
 }
+
+func TestLocationRecordFields(t *testing.T) {
+	data, err := LoadJSON(testHome + "Location-History-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Locations) != 3 {
+		t.Fatalf("Expected 3 locations, got %d", len(data.Locations))
+	}
+
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "locations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, input := range data.Locations {
+		loc, err := FormatInput(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = InsertLocation(db, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locations, err := GetLocationsWithAccuracy(db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 2 {
+		t.Fatalf("Expected 2 accurate locations, got %d", len(locations))
+	}
+	expected := Location{
+		Unixtime:         1551521820,
+		UnixTimeMs:       1551521820000,
+		Latitude:         377802295,
+		Longitude:        -1224104155,
+		Accuracy:         5,
+		Altitude:         29,
+		VerticalAccuracy: 2,
+		Velocity:         14,
+		Heading:          270,
+		Source:           "GPS",
+		DeviceTag:        1234567890,
+		Activities: []LocationActivity{
+			{Unixtime: 1551521815, Type: "IN_VEHICLE", Confidence: 75},
+			{Unixtime: 1551521815, Type: "ON_BICYCLE", Confidence: 15},
+			{Unixtime: 1551521818, Type: "IN_VEHICLE", Confidence: 90},
+		},
+	}
+	if !reflect.DeepEqual(locations[1], expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, locations[1])
+	}
+
+	counts, err := GetActivityTypeCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCounts := []ItemFreq{{Name: "IN_VEHICLE", Count: 2}, {Name: "STILL", Count: 1}}
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("Expected %v, got %v", expectedCounts, counts)
+	}
+
+	err = DeleteLocation(db, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err = GetActivityTypeCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[0].Name != "STILL" {
+		t.Fatalf("Expected only STILL after delete, got %v", counts)
+	}
+}
+
+func TestLoadRecordsJSON(t *testing.T) {
+	data, err := LoadJSON(testHome + "Records-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Locations) != 2 {
+		t.Fatalf("Expected 2 locations, got %d", len(data.Locations))
+	}
+
+	loc, err := FormatInput(data.Locations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Unixtime != 1551521700 || loc.UnixTimeMs != 1551521700123 {
+		t.Fatalf("Expected 1551521700123ms, got %d (%dms)", loc.Unixtime, loc.UnixTimeMs)
+	}
+	if len(loc.Activities) != 1 || loc.Activities[0].Unixtime != 1551521690 || loc.Activities[0].Type != "WALKING" {
+		t.Fatalf("Expected a WALKING activity, got %v", loc.Activities)
+	}
+
+	loc, err = FormatInput(data.Locations[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offsets other than Z are honoured
+	if loc.Unixtime != 1551521760 || loc.UnixTimeMs != 1551521760000 {
+		t.Fatalf("Expected 1551521760000ms, got %d (%dms)", loc.Unixtime, loc.UnixTimeMs)
+	}
+}
+
+func TestFormatInputErrors(t *testing.T) {
+	inputs := []LocationInput{
+		{},
+		{Timestamp: "yesterday"},
+		{Time: "2019-03-02 10:15:00"},
+		{Time: "2019-03-02T10:15:00Z", Activity: []ActivityInput{{}}},
+	}
+	for _, input := range inputs {
+		_, err := FormatInput(input)
+		if err == nil {
+			t.Fatalf("Expected an error for %+v", input)
+		}
+	}
+
+	loc, err := FormatInput(LocationInput{Timestamp: "-1500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Unixtime != -2 || loc.UnixTimeMs != -1500 {
+		t.Fatalf("Expected -2 seconds, got %d", loc.Unixtime)
+	}
+}
@@ -0,0 +1,194 @@
+package ParseTakeout
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+)
+
+// Sink receives the records a Parser produces
+type Sink interface {
+	AddItem(Result) error
+	AddLocation(Location) error
+	AddPlaceVisit(PlaceVisit) error
+	AddActivitySegment(ActivitySegment) error
+}
+
+// Parser handles the files of one Takeout product
+type Parser interface {
+	Name() string
+	// Match reports whether the parser handles the file at path inside a
+	// Takeout archive, e.g. "Takeout/My Activity/Search/MyActivity.html"
+	Match(path string) bool
+	Parse(r io.Reader, sink Sink) error
+}
+
+// ContextParser is a Parser that can stop mid file once ctx is done, rather
+// than when the sink next fails
+type ContextParser interface {
+	Parser
+	ParseContext(ctx context.Context, r io.Reader, sink Sink) error
+}
+
+var parsers []Parser
+
+// RegisterParser adds p to the registry. Parsers registered later take
+// precedence, so a downstream parser can replace a built in one for the same
+// paths. It is meant to be called from init functions.
+func RegisterParser(p Parser) {
+	parsers = append(parsers, p)
+}
+
+// ParserFor returns the registered parser for path, or nil if there is none
+func ParserFor(path string) Parser {
+	for i := len(parsers) - 1; i >= 0; i-- {
+		if parsers[i].Match(path) {
+			return parsers[i]
+		}
+	}
+	return nil
+}
+
+// Collector is a Sink that keeps every record in memory
+type Collector struct {
+	Items            []Result
+	Locations        []Location
+	PlaceVisits      []PlaceVisit
+	ActivitySegments []ActivitySegment
+}
+
+func (c *Collector) AddItem(res Result) error {
+	c.Items = append(c.Items, res)
+	return nil
+}
+
+func (c *Collector) AddLocation(loc Location) error {
+	c.Locations = append(c.Locations, loc)
+	return nil
+}
+
+func (c *Collector) AddPlaceVisit(visit PlaceVisit) error {
+	c.PlaceVisits = append(c.PlaceVisits, visit)
+	return nil
+}
+
+func (c *Collector) AddActivitySegment(segment ActivitySegment) error {
+	c.ActivitySegments = append(c.ActivitySegments, segment)
+	return nil
+}
+
+// isMyActivity reports whether name is in the My Activity folder of an export
+// in the language of any registered locale
+func isMyActivity(name string) bool {
+	for _, l := range locales {
+		if l.inActivityFolder(name) {
+			return true
+		}
+	}
+	return false
+}
+
+type myActivityHTMLParser struct{}
+
+func (myActivityHTMLParser) Name() string {
+	return "My Activity HTML"
+}
+
+func (myActivityHTMLParser) Match(name string) bool {
+	return isMyActivity(name) && strings.ToLower(path.Ext(name)) == ".html"
+}
+
+func (myActivityHTMLParser) Parse(r io.Reader, sink Sink) error {
+	return ParseHTMLReader(r, sink.AddItem)
+}
+
+func (myActivityHTMLParser) ParseContext(ctx context.Context, r io.Reader, sink Sink) error {
+	return ParseHTMLReaderContext(ctx, r, sink.AddItem)
+}
+
+type myActivityJSONParser struct{}
+
+func (myActivityJSONParser) Name() string {
+	return "My Activity JSON"
+}
+
+func (myActivityJSONParser) Match(name string) bool {
+	return isMyActivity(name) && strings.ToLower(path.Ext(name)) == ".json"
+}
+
+func (myActivityJSONParser) Parse(r io.Reader, sink Sink) error {
+	return ParseActivityJSONReader(r, sink.AddItem)
+}
+
+type locationHistoryParser struct{}
+
+func (locationHistoryParser) Name() string {
+	return "Location History"
+}
+
+func (locationHistoryParser) Match(name string) bool {
+	base := path.Base(name)
+	return base == "Location History.json" || base == "Records.json"
+}
+
+func (locationHistoryParser) Parse(r io.Reader, sink Sink) error {
+	return StreamLocations(r, sink.AddLocation)
+}
+
+func (locationHistoryParser) ParseContext(ctx context.Context, r io.Reader, sink Sink) error {
+	return StreamLocationsContext(ctx, r, sink.AddLocation)
+}
+
+type semanticLocationParser struct{}
+
+func (semanticLocationParser) Name() string {
+	return "Semantic Location History"
+}
+
+func (semanticLocationParser) Match(name string) bool {
+	return strings.Contains(name, "Semantic Location History/") && strings.ToLower(path.Ext(name)) == ".json"
+}
+
+func (semanticLocationParser) Parse(r io.Reader, sink Sink) error {
+	data, err := LoadSemanticJSONReader(r)
+	if err != nil {
+		return err
+	}
+	for _, visit := range data.PlaceVisits {
+		err := sink.AddPlaceVisit(visit)
+		if err != nil {
+			return err
+		}
+	}
+	for _, segment := range data.ActivitySegments {
+		err := sink.AddActivitySegment(segment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type browserHistoryParser struct{}
+
+func (browserHistoryParser) Name() string {
+	return "Chrome Browser History"
+}
+
+func (browserHistoryParser) Match(name string) bool {
+	base := path.Base(name)
+	return base == "BrowserHistory.json" || base == "Browser History.json"
+}
+
+func (browserHistoryParser) Parse(r io.Reader, sink Sink) error {
+	return ParseBrowserHistoryReader(r, sink.AddItem)
+}
+
+func init() {
+	RegisterParser(myActivityHTMLParser{})
+	RegisterParser(myActivityJSONParser{})
+	RegisterParser(locationHistoryParser{})
+	RegisterParser(semanticLocationParser{})
+	RegisterParser(browserHistoryParser{})
+}
@@ -0,0 +1,103 @@
+package ParseTakeout
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParserFor(t *testing.T) {
+	paths := map[string]string{
+		"Takeout/My Activity/Search/MyActivity.html":            "My Activity HTML",
+		"Takeout/My Activity/YouTube/MyActivity.json":           "My Activity JSON",
+		"Takeout/Meine Aktivitäten/Suche/MeineAktivitäten.html": "My Activity HTML",
+		"Takeout/Mon activité/YouTube/MonActivité.json":         "My Activity JSON",
+		"Takeout/Mi actividad/Búsqueda/MiActividad.html":        "My Activity HTML",
+		"Takeout/マイアクティビティ/YouTube/マイアクティビティ.json":              "My Activity JSON",
+		"Takeout/Location History/Location History.json":        "Location History",
+		"Takeout/Location History/Records.json":                 "Location History",
+		"Takeout/Chrome/BrowserHistory.json":                    "Chrome Browser History",
+		"Takeout/Drive/My Activity notes/notes.txt":             "",
+		"Takeout/YouTube and YouTube Music/history/notes.txt":   "",
+	}
+	for path, name := range paths {
+		p := ParserFor(path)
+		if p == nil {
+			if name != "" {
+				t.Fatalf("Expected %s parser for %s", name, path)
+			}
+			continue
+		}
+		if p.Name() != name {
+			t.Fatalf("Expected %s parser for %s, got %s", name, path, p.Name())
+		}
+	}
+}
+
+type notesParser struct{}
+
+func (notesParser) Name() string {
+	return "Notes"
+}
+
+func (notesParser) Match(path string) bool {
+	return strings.HasSuffix(path, ".txt")
+}
+
+func (notesParser) Parse(r io.Reader, sink Sink) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return sink.AddItem(Result{
+		Title:    "Notes",
+		Action:   "Read",
+		Item:     strings.TrimSpace(string(data)),
+		Date:     "2020-01-01T00:00:00",
+		UnixTime: 1577836800,
+	})
+}
+
+func TestRegisterParser(t *testing.T) {
+	registered := parsers
+	defer func() { parsers = registered }()
+
+	RegisterParser(notesParser{})
+
+	p := ParserFor("Takeout/Drive/notes.txt")
+	if p == nil || p.Name() != "Notes" {
+		t.Fatal("Expected the registered notes parser")
+	}
+
+	var c Collector
+	err := p.Parse(strings.NewReader("some notes\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Items) != 1 || c.Items[0].Item != "some notes" {
+		t.Fatalf("Unexpected items %v", c.Items)
+	}
+}
+
+func TestParseBrowserHistory(t *testing.T) {
+	history := `{"Browser History": [
+		{"title": "The Go Programming Language", "url": "https://golang.org/", "time_usec": 1578370032000000},
+		{"title": "", "url": "https://example.com/", "time_usec": 1578370033000000}
+	]}`
+
+	var c Collector
+	err := ParserFor("Takeout/Chrome/BrowserHistory.json").Parse(strings.NewReader(history), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(c.Items))
+	}
+	if c.Items[0].Action != "Visited" || c.Items[0].UnixTime != 1578370032 {
+		t.Fatalf("Unexpected item %v", c.Items[0])
+	}
+	if c.Items[1].Item != "https://example.com/" {
+		t.Fatalf("Expected the URL as the item of an untitled page, got %s", c.Items[1].Item)
+	}
+}
@@ -0,0 +1,351 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// PlaceVisit is a stay at one place from Semantic Location History
+type PlaceVisit struct {
+	StartTime int64  `json:"starttime"`
+	EndTime   int64  `json:"endtime"`
+	Latitude  int64  `json:"latitude"`
+	Longitude int64  `json:"longitude"`
+	PlaceID   string `json:"placeid"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	// Confidence is Google's label for the place, e.g. HIGH_CONFIDENCE
+	Confidence      string `json:"confidence"`
+	VisitConfidence int    `json:"visitconfidence"`
+}
+
+// ActivitySegment is a journey between two places from Semantic Location
+// History
+type ActivitySegment struct {
+	StartTime      int64 `json:"starttime"`
+	EndTime        int64 `json:"endtime"`
+	StartLatitude  int64 `json:"startlatitude"`
+	StartLongitude int64 `json:"startlongitude"`
+	EndLatitude    int64 `json:"endlatitude"`
+	EndLongitude   int64 `json:"endlongitude"`
+	// Distance is in meters
+	Distance     int        `json:"distance"`
+	ActivityType string     `json:"activitytype"`
+	Confidence   string     `json:"confidence"`
+	Waypoints    []Waypoint `json:"waypoints"`
+}
+
+type Waypoint struct {
+	Latitude  int64 `json:"latitude"`
+	Longitude int64 `json:"longitude"`
+}
+
+type SemanticData struct {
+	PlaceVisits      []PlaceVisit      `json:"placevisits"`
+	ActivitySegments []ActivitySegment `json:"activitysegments"`
+}
+
+type semanticInput struct {
+	TimelineObjects []struct {
+		PlaceVisit      *placeVisitInput      `json:"placeVisit"`
+		ActivitySegment *activitySegmentInput `json:"activitySegment"`
+	} `json:"timelineObjects"`
+}
+
+type semanticLocationInput struct {
+	Latitude  int64  `json:"latitudeE7"`
+	Longitude int64  `json:"longitudeE7"`
+	PlaceID   string `json:"placeId"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+}
+
+type durationInput struct {
+	StartTimestamp string `json:"startTimestampMs"`
+	EndTimestamp   string `json:"endTimestampMs"`
+	StartTime      string `json:"startTimestamp"`
+	EndTime        string `json:"endTimestamp"`
+}
+
+type placeVisitInput struct {
+	Location        semanticLocationInput `json:"location"`
+	Duration        durationInput         `json:"duration"`
+	PlaceConfidence string                `json:"placeConfidence"`
+	VisitConfidence int                   `json:"visitConfidence"`
+}
+
+type activitySegmentInput struct {
+	StartLocation semanticLocationInput `json:"startLocation"`
+	EndLocation   semanticLocationInput `json:"endLocation"`
+	Duration      durationInput         `json:"duration"`
+	Distance      int                   `json:"distance"`
+	ActivityType  string                `json:"activityType"`
+	Confidence    string                `json:"confidence"`
+	WaypointPath  struct {
+		Waypoints []struct {
+			Latitude  int64 `json:"latE7"`
+			Longitude int64 `json:"lngE7"`
+		} `json:"waypoints"`
+	} `json:"waypointPath"`
+}
+
+func (d durationInput) times() (int64, int64, error) {
+	start, err := parseLocationTimestamp(d.StartTimestamp, d.StartTime)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Start: %v", err)
+	}
+	end, err := parseLocationTimestamp(d.EndTimestamp, d.EndTime)
+	if err != nil {
+		return 0, 0, fmt.Errorf("End: %v", err)
+	}
+	return unixSeconds(start), unixSeconds(end), nil
+}
+
+// LoadSemanticJSON reads one Semantic Location History/YYYY/YYYY_MONTH.json
+func LoadSemanticJSON(filePath string) (*SemanticData, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadSemanticJSONReader(f)
+}
+
+func LoadSemanticJSONReader(r io.Reader) (*SemanticData, error) {
+	var input semanticInput
+	err := json.NewDecoder(r).Decode(&input)
+	if err != nil {
+		return nil, err
+	}
+
+	data := SemanticData{
+		PlaceVisits:      []PlaceVisit{},
+		ActivitySegments: []ActivitySegment{},
+	}
+	for i, obj := range input.TimelineObjects {
+		if v := obj.PlaceVisit; v != nil {
+			start, end, err := v.Duration.times()
+			if err != nil {
+				return nil, fmt.Errorf("Timeline object %d: %v", i, err)
+			}
+			data.PlaceVisits = append(data.PlaceVisits, PlaceVisit{
+				StartTime:       start,
+				EndTime:         end,
+				Latitude:        v.Location.Latitude,
+				Longitude:       v.Location.Longitude,
+				PlaceID:         v.Location.PlaceID,
+				Name:            v.Location.Name,
+				Address:         v.Location.Address,
+				Confidence:      v.PlaceConfidence,
+				VisitConfidence: v.VisitConfidence,
+			})
+		}
+		if s := obj.ActivitySegment; s != nil {
+			start, end, err := s.Duration.times()
+			if err != nil {
+				return nil, fmt.Errorf("Timeline object %d: %v", i, err)
+			}
+			segment := ActivitySegment{
+				StartTime:      start,
+				EndTime:        end,
+				StartLatitude:  s.StartLocation.Latitude,
+				StartLongitude: s.StartLocation.Longitude,
+				EndLatitude:    s.EndLocation.Latitude,
+				EndLongitude:   s.EndLocation.Longitude,
+				Distance:       s.Distance,
+				ActivityType:   s.ActivityType,
+				Confidence:     s.Confidence,
+			}
+			for _, w := range s.WaypointPath.Waypoints {
+				segment.Waypoints = append(segment.Waypoints, Waypoint{
+					Latitude:  w.Latitude,
+					Longitude: w.Longitude,
+				})
+			}
+			data.ActivitySegments = append(data.ActivitySegments, segment)
+		}
+	}
+	return &data, nil
+}
+
+func InsertPlaceVisit(db *sql.DB, visit PlaceVisit) error {
+	return InsertPlaceVisitContext(context.Background(), db, visit)
+}
+
+// InsertPlaceVisitContext is InsertPlaceVisit, stopped when ctx is done
+func InsertPlaceVisitContext(ctx context.Context, db *sql.DB, visit PlaceVisit) error {
+	return insertPlaceVisit(ctx, db, visit, sql.NullInt64{})
+}
+
+func insertPlaceVisit(ctx context.Context, db execer, visit PlaceVisit, importID sql.NullInt64) error {
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO "placevisits" ("starttime", "endtime", "latitude", "longitude", "placeid", "name", "address", "confidence", "visitconfidence", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, visit.StartTime, visit.EndTime, visit.Latitude, visit.Longitude, visit.PlaceID, visit.Name, visit.Address, visit.Confidence, visit.VisitConfidence, visit.Hash(), importID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func InsertActivitySegment(db *sql.DB, segment ActivitySegment) error {
+	return InsertActivitySegmentContext(context.Background(), db, segment)
+}
+
+// InsertActivitySegmentContext is InsertActivitySegment, stopped when ctx is done
+func InsertActivitySegmentContext(ctx context.Context, db *sql.DB, segment ActivitySegment) error {
+	return insertActivitySegment(ctx, db, segment, sql.NullInt64{})
+}
+
+func insertActivitySegment(ctx context.Context, db execer, segment ActivitySegment, importID sql.NullInt64) error {
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO "activitysegments" ("starttime", "endtime", "startlatitude", "startlongitude", "endlatitude", "endlongitude", "distance", "activitytype", "confidence", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, segment.StartTime, segment.EndTime, segment.StartLatitude, segment.StartLongitude, segment.EndLatitude, segment.EndLongitude, segment.Distance, segment.ActivityType, segment.Confidence, segment.Hash(), importID)
+	if err != nil {
+		return err
+	}
+	return insertWaypoints(ctx, db, segment)
+}
+
+func insertWaypoints(ctx context.Context, db execer, segment ActivitySegment) error {
+	for i, w := range segment.Waypoints {
+		_, err := db.ExecContext(ctx, `
+		INSERT INTO "activitywaypoints" ("starttime", "seq", "latitude", "longitude")
+		VALUES (?, ?, ?, ?);
+		`, segment.StartTime, i, w.Latitude, w.Longitude)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetPlaceVisits(db *sql.DB, begin, end int64) ([]PlaceVisit, error) {
+	return GetPlaceVisitsContext(context.Background(), db, begin, end)
+}
+
+// GetPlaceVisitsContext is GetPlaceVisits, stopped when ctx is done
+func GetPlaceVisitsContext(ctx context.Context, db *sql.DB, begin, end int64) ([]PlaceVisit, error) {
+	return queryPlaceVisits(ctx, db, `
+	WHERE "starttime" >= ? AND "starttime" < ?
+	ORDER BY "starttime" ASC`, begin, end)
+}
+
+func queryPlaceVisits(ctx context.Context, db queryer, where string, args ...interface{}) ([]PlaceVisit, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "starttime", "endtime", "latitude", "longitude", "placeid", "name", "address", "confidence", "visitconfidence"
+	FROM "placevisits" `+where+`;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []PlaceVisit{}
+	for rows.Next() {
+		var v PlaceVisit
+		if err := rows.Scan(&v.StartTime, &v.EndTime, &v.Latitude, &v.Longitude, &v.PlaceID, &v.Name, &v.Address, &v.Confidence, &v.VisitConfidence); err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func GetActivitySegments(db *sql.DB, begin, end int64) ([]ActivitySegment, error) {
+	return GetActivitySegmentsContext(context.Background(), db, begin, end)
+}
+
+// GetActivitySegmentsContext is GetActivitySegments, stopped when ctx is done
+func GetActivitySegmentsContext(ctx context.Context, db *sql.DB, begin, end int64) ([]ActivitySegment, error) {
+	return queryActivitySegments(ctx, db, `
+	WHERE "starttime" >= ? AND "starttime" < ?
+	ORDER BY "starttime" ASC`, begin, end)
+}
+
+// queryActivitySegments selects the segments matching where along with their
+// waypoints
+func queryActivitySegments(ctx context.Context, db queryer, where string, args ...interface{}) ([]ActivitySegment, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "starttime", "endtime", "startlatitude", "startlongitude", "endlatitude", "endlongitude", "distance", "activitytype", "confidence"
+	FROM "activitysegments" `+where+`;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ActivitySegment{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var s ActivitySegment
+		if err := rows.Scan(&s.StartTime, &s.EndTime, &s.StartLatitude, &s.StartLongitude, &s.EndLatitude, &s.EndLongitude, &s.Distance, &s.ActivityType, &s.Confidence); err != nil {
+			return nil, err
+		}
+		index[s.StartTime] = len(results)
+		results = append(results, s)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	waypoints, err := db.QueryContext(ctx, `
+	SELECT "starttime", "latitude", "longitude" FROM "activitywaypoints"
+	WHERE "starttime" IN (
+		SELECT "starttime" FROM "activitysegments" `+where+`
+	) ORDER BY "starttime", "seq";
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer waypoints.Close()
+
+	for waypoints.Next() {
+		var start int64
+		var w Waypoint
+		if err := waypoints.Scan(&start, &w.Latitude, &w.Longitude); err != nil {
+			return nil, err
+		}
+		i, ok := index[start]
+		if !ok {
+			continue
+		}
+		results[i].Waypoints = append(results[i].Waypoints, w)
+	}
+	// Check for errors from iterating over rows.
+	if err := waypoints.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// PlaceFreq is how often and for how long a place was visited
+type PlaceFreq struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	PlaceID string `json:"placeid"`
+	Count   int    `json:"count"`
+	// Duration is the total time spent there in seconds
+	Duration int64 `json:"duration"`
+}
+
+// ActivityDistance is how far was travelled by one activity type, in meters
+type ActivityDistance struct {
+	ActivityType string `json:"activitytype"`
+	Distance     int    `json:"distance"`
+	Count        int    `json:"count"`
+}
@@ -0,0 +1,113 @@
+package ParseTakeout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSemanticJSON(t *testing.T) {
+	data, err := LoadSemanticJSON(testHome + "Semantic-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.PlaceVisits) != 3 || len(data.ActivitySegments) != 2 {
+		t.Fatalf("Expected 3 visits and 2 segments, got %d and %d", len(data.PlaceVisits), len(data.ActivitySegments))
+	}
+
+	visit := data.PlaceVisits[0]
+	if visit.Name != "Home" || visit.PlaceID != "ChIJhome" || visit.StartTime != 1551517200 || visit.EndTime != 1551520800 || visit.Confidence != "HIGH_CONFIDENCE" {
+		t.Fatalf("Unexpected visit %+v", visit)
+	}
+	// ISO timestamps are read like timestampMs ones
+	if data.PlaceVisits[1].StartTime != 1551522600 {
+		t.Fatalf("Expected the cafe visit at 1551522600, got %d", data.PlaceVisits[1].StartTime)
+	}
+
+	segment := data.ActivitySegments[0]
+	if segment.ActivityType != "IN_PASSENGER_VEHICLE" || segment.Distance != 4200 || len(segment.Waypoints) != 3 {
+		t.Fatalf("Unexpected segment %+v", segment)
+	}
+}
+
+func TestLoadSemanticJSONErrors(t *testing.T) {
+	_, err := LoadSemanticJSONReader(strings.NewReader(`{"timelineObjects": [{"placeVisit": {"duration": {}}}]}`))
+	if err == nil {
+		t.Fatal("Expected an error for a visit without a duration")
+	}
+}
+
+func TestSemanticYearlySummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "semantic.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts, err := ImportArchive(db, testHome+"Semantic-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only files under a Semantic Location History folder are matched
+	if len(counts) != 0 {
+		t.Fatalf("Expected no parser for the bare sample, got %v", counts)
+	}
+
+	f, err := os.Open(testHome + "Semantic-Sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(db, 0)
+	count, ok, err := importEntry(w, "", "Takeout/Location History/Semantic Location History/2019/2019_MARCH.json", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || count.New != 5 {
+		t.Fatalf("Expected 5 records inserted, got %v", count)
+	}
+
+	segments, err := GetActivitySegments(db, 0, 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || len(segments[0].Waypoints) != 3 || segments[0].Waypoints[1].Latitude != 377799295 {
+		t.Fatalf("Expected the stored waypoints, got %v", segments)
+	}
+
+	summary, err := GetSummaryofYear(db, 2019, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.TopPlaces) != 2 {
+		t.Fatalf("Expected 2 top places, got %v", summary.TopPlaces)
+	}
+	home := summary.TopPlaces[0]
+	if home.Name != "Home" || home.Count != 2 || home.Duration != 3600+8*3600+20*60 {
+		t.Fatalf("Expected Home visited twice, got %+v", home)
+	}
+	if len(summary.DistanceByActivity) != 2 || summary.DistanceByActivity[0].ActivityType != "IN_PASSENGER_VEHICLE" || summary.DistanceByActivity[0].Distance != 4200 {
+		t.Fatalf("Unexpected distances %v", summary.DistanceByActivity)
+	}
+
+	summary, err = GetSummaryofYear(db, 2018, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.TopPlaces) != 0 || len(summary.DistanceByActivity) != 0 {
+		t.Fatalf("Expected nothing in 2018, got %v", summary)
+	}
+}
@@ -1,11 +1,13 @@
 package ParseTakeout
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,7 +16,35 @@ import (
 	"golang.org/x/net/html"
 )
 
-var actions = []string{"Listened to", "Searched for", "Visited", "Used", "Viewed", "Watched", "Dismissed notification about", "Received notification about", "Saw articles in", "Saw videos in", "Read", "Watched a video in", "Said"}
+// zoneAbbreviations maps the timezone abbreviation at the end of a My Activity
+// date to the location it is parsed in when neither HTMLParser.Zones nor the
+// locale has it. Abbreviations are ambiguous, so these are fixed offsets.
+var zoneAbbreviations = map[string]*time.Location{
+	"UTC":  time.UTC,
+	"GMT":  time.UTC,
+	"EST":  time.FixedZone("EST", -5*60*60),
+	"EDT":  time.FixedZone("EDT", -4*60*60),
+	"CST":  time.FixedZone("CST", -6*60*60),
+	"CDT":  time.FixedZone("CDT", -5*60*60),
+	"MST":  time.FixedZone("MST", -7*60*60),
+	"MDT":  time.FixedZone("MDT", -6*60*60),
+	"PST":  time.FixedZone("PST", -8*60*60),
+	"PDT":  time.FixedZone("PDT", -7*60*60),
+	"AKST": time.FixedZone("AKST", -9*60*60),
+	"AKDT": time.FixedZone("AKDT", -8*60*60),
+	"HST":  time.FixedZone("HST", -10*60*60),
+	"BST":  time.FixedZone("BST", 1*60*60),
+	"WET":  time.FixedZone("WET", 0),
+	"WEST": time.FixedZone("WEST", 1*60*60),
+	"CET":  time.FixedZone("CET", 1*60*60),
+	"CEST": time.FixedZone("CEST", 2*60*60),
+	"EET":  time.FixedZone("EET", 2*60*60),
+	"EEST": time.FixedZone("EEST", 3*60*60),
+	"IST":  time.FixedZone("IST", 5*60*60+30*60),
+	"JST":  time.FixedZone("JST", 9*60*60),
+	"AEST": time.FixedZone("AEST", 10*60*60),
+	"AEDT": time.FixedZone("AEDT", 11*60*60),
+}
 
 func ReadHtml(filePath string) (string, error) {
 	bytes, err := ioutil.ReadFile(filePath)
@@ -24,143 +54,433 @@ func ReadHtml(filePath string) (string, error) {
 	return string(bytes), nil
 }
 
-func body(doc *html.Node) (*html.Node, error) {
-	var body *html.Node
-	var crawler func(*html.Node)
-	crawler = func(node *html.Node) {
-		if node.Type == html.ElementNode && node.Data == "body" {
-			body = node
-			return
-		}
-		for child := node.FirstChild; child != nil; child = child.NextSibling {
-			crawler(child)
-		}
+func ParseHTML(filePath string) ([]Result, error) {
+	return ParseHTMLContext(context.Background(), filePath)
+}
+
+// ParseHTMLContext is ParseHTML, stopped when ctx is done
+func ParseHTMLContext(ctx context.Context, filePath string) ([]Result, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
 	}
-	crawler(doc)
-	if body != nil {
-		return body, nil
+	defer f.Close()
+
+	results := []Result{}
+	err = ParseHTMLReaderContext(ctx, f, func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("Missing <body> in the node tree")
+	return results, nil
 }
 
-func renderNode(n *html.Node) string {
-	var buf bytes.Buffer
-	w := io.Writer(&buf)
-	html.Render(w, n)
-	return buf.String()
+// ParseHTMLReader parses a My Activity HTML document, detecting its locale
+func ParseHTMLReader(r io.Reader, fn func(Result) error) error {
+	return ParseHTMLReaderContext(context.Background(), r, fn)
 }
 
-func ParseHTML(filePath string) ([]Result, error) {
-	results := []Result{}
+// ParseHTMLReaderContext is ParseHTMLReader, stopped when ctx is done
+func ParseHTMLReaderContext(ctx context.Context, r io.Reader, fn func(Result) error) error {
+	p := HTMLParser{}
+	return p.ParseContext(ctx, r, fn)
+}
 
-	s, err := ReadHtml(filePath)
-	if err != nil {
-		return nil, err
+type HTMLParser struct {
+	// Locale of the document. When nil it is taken from the lang attribute of
+	// <html> or detected from the first action a registered locale recognises.
+	Locale *Locale
+	// Zones maps timezone abbreviations to the location dates ending in them
+	// are parsed in, ahead of the locale's and the fixed offsets used by
+	// default. Set e.g. "EST" to America/New_York to match the zone of the
+	// account that made the export.
+	Zones map[string]*time.Location
+}
+
+// segment is a run of text in an activity cell, with the link it sits in
+type segment struct {
+	text string
+	url  string
+}
+
+func lineText(line []segment) string {
+	text := ""
+	for _, seg := range line {
+		text += seg.text
 	}
-	//Strip down to the body
-	doc, _ := html.Parse(strings.NewReader(s))
-	bn, err := body(doc)
-	if err != nil {
-		return nil, err
+	return text
+}
+
+// firstLine returns the first line with any text, nil if there is none
+func firstLine(lines [][]segment) []segment {
+	for _, line := range lines {
+		if strings.TrimSpace(lineText(line)) != "" {
+			return line
+		}
 	}
-	body := renderNode(bn)
+	return nil
+}
 
-	z := html.NewTokenizer(strings.NewReader(body))
+func hasClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse tokenizes a My Activity HTML document and calls fn with each Result as
+// soon as it is complete, including its caption block. Returning an error from
+// fn stops parsing and that error is returned.
+func (p HTMLParser) Parse(r io.Reader, fn func(Result) error) error {
+	return p.ParseContext(context.Background(), r, fn)
+}
+
+// ParseContext is Parse, checking ctx before each token so a cancelled parse
+// stops mid document with the error of ctx
+func (p HTMLParser) ParseContext(ctx context.Context, r io.Reader, fn func(Result) error) error {
+	z := html.NewTokenizer(r)
+	locale := p.Locale
 
 	var res Result
-	nextItem := "title"
-	getChannel := false
+	inHead := false
+	href := ""
+
+	// Each activity is a title, a content cell split into lines by <br> and a
+	// caption. A Result is held back after its content until the caption is read.
+	titleTag := ""
+	awaitingContent := false
+	inContent := false
+	var lines [][]segment
+	pending := false
+
+	inCaption := false
+	inBold := false
+	section := ""
+	captionText := ""
+	captionURL := ""
+
+	emit := func() error {
+		if !pending {
+			return nil
+		}
+		pending = false
+		err := fn(res)
+		// Clear results
+		res = Result{}
+		return err
+	}
+	endCaptionLine := func() {
+		res.addCaptionLine(section, captionText, captionURL)
+		captionText = ""
+		captionURL = ""
+	}
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		tt := z.Next()
-		switch {
-		case tt == html.ErrorToken:
+		switch tt {
+		case html.ErrorToken:
 			// End of the document, we're done
-			return results, nil
-		case tt == html.TextToken:
-			t := z.Token()
-			// TODO: I think this can probably be transitioned to some kind of middleware-esque flow
-			//This is 🤮
-			switch nextItem {
-			case "title":
-				res.Title = t.Data
-				nextItem = "action"
-			case "action":
-				exactMatch := false
-				data := strings.TrimSpace(t.Data)
-				//Check if action == Watched
-				if data == "Watched" && res.Title != "Google News" {
-					getChannel = true
-				}
-				for _, action := range actions {
-					if data == action {
-						//If exact match then next node is item
-						res.Action = data
-						exactMatch = true
-					}
-					if !exactMatch {
-						if strings.Contains(data, action) {
-							res.Action = action
-							res.Item = strings.TrimSpace(strings.TrimPrefix(data, action))
-						}
-					}
-				}
-				if exactMatch {
-					nextItem = "item"
+			if z.Err() == io.EOF {
+				return emit()
+			}
+			return z.Err()
+		case html.TextToken:
+			if inHead {
+				continue
+			}
+			text := string(z.Text())
+			switch {
+			case titleTag != "":
+				res.Title += text
+			case inContent:
+				line := lines[len(lines)-1]
+				if len(line) > 0 && line[len(line)-1].url == href {
+					line[len(line)-1].text += text
 				} else {
-					nextItem = "date"
+					lines[len(lines)-1] = append(line, segment{text: text, url: href})
 				}
-			case "item":
-				res.Item = t.Data
-				if getChannel {
-					nextItem = "channel"
-					getChannel = false
+			case inCaption:
+				if inBold {
+					// Section headers look like <b>Products:</b>
+					section = locale.section(text)
 				} else {
-					nextItem = "date"
+					captionText += text
 				}
-			case "channel":
-				res.Channel = t.Data
-				nextItem = "date"
-			case "date":
-				layout, err := dateparse.ParseFormat(t.Data)
-				if err != nil {
-					res.Date = ""
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch {
+			case tag == "head":
+				inHead = false
+			case tag == "a":
+				href = ""
+			case tag == "b":
+				inBold = false
+			case tag == titleTag:
+				titleTag = ""
+			case tag == "div" && inContent:
+				inContent = false
+				if locale == nil {
+					locale = detectLocale(firstLine(lines))
 				}
-				t, err := time.Parse(layout, t.Data)
-				if err != nil {
-					res.Date = ""
-				} else {
-					res.Date = fmt.Sprintf("%02d-%02d-%02dT%02d:%02d:%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
-					res.UnixTime = t.Unix()
+				l := locale
+				if l == nil {
+					l = English()
+				}
+				res.parseContent(lines, l, p.Zones)
+				pending = true
+			case tag == "div" && inCaption:
+				endCaptionLine()
+				inCaption = false
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			var class, link, lang string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "class":
+					class = string(val)
+				case "href":
+					link = string(val)
+				case "lang":
+					lang = string(val)
 				}
-
-				results = append(results, res)
-				// Clear results
-				res.Title = ""
-				res.Action = ""
-				res.Item = ""
-				res.Date = ""
-				res.UnixTime = 0
-				nextItem = "unknown"
 			}
 
-		case tt == html.StartTagToken:
-			if nextItem == "unknown" {
-				//Check for new item denoted by class="mdl-typography--title"
-				_, val, more := z.TagAttr()
-				if string(val) == "mdl-typography--title" {
-					// Next item will be title
-					nextItem = "title"
+			switch tag {
+			case "head":
+				inHead = true
+			case "body":
+				inHead = false
+			case "html":
+				if locale == nil && lang != "" {
+					locale, _ = GetLocale(lang)
+				}
+			case "a":
+				href = link
+				if inCaption {
+					captionURL = link
 				}
-				for more {
-					_, val, more = z.TagAttr()
-					if string(val) == "mdl-typography--title" {
-						// Next item will be title
-						nextItem = "title"
-					}
+			case "br":
+				if inContent {
+					lines = append(lines, nil)
+				}
+				if inCaption {
+					endCaptionLine()
+				}
+			case "b":
+				if inCaption {
+					endCaptionLine()
+					inBold = true
 				}
 			}
+
+			classes := strings.Fields(class)
+			switch {
+			//Check for new item denoted by class="mdl-typography--title"
+			case hasClass(classes, "mdl-typography--title"):
+				if err := emit(); err != nil {
+					return err
+				}
+				res = Result{}
+				titleTag = tag
+				awaitingContent = true
+			case awaitingContent && tag == "div" && hasClass(classes, "mdl-typography--body-1") && !hasClass(classes, "mdl-typography--text-right"):
+				awaitingContent = false
+				inContent = true
+				lines = [][]segment{nil}
+			//Check for the caption holding products, locations and details
+			case pending && hasClass(classes, "mdl-typography--caption"):
+				inCaption = true
+				section = ""
+			}
+		}
+	}
+}
+
+// parseContent fills in the action, item, channel and date from the lines of
+// an activity's content cell. The date is always the last line.
+func (r *Result) parseContent(lines [][]segment, l *Locale, zones map[string]*time.Location) {
+	var filled [][]segment
+	for _, line := range lines {
+		if strings.TrimSpace(lineText(line)) != "" {
+			filled = append(filled, line)
+		}
+	}
+	if len(filled) == 0 {
+		return
+	}
+
+	t, err := parseActivityDate(lineText(filled[len(filled)-1]), l, zones)
+	if err == nil {
+		r.Date = formatDate(t)
+		r.UnixTime = t.Unix()
+		_, r.UTCOffset = t.Zone()
+	}
+
+	activity := filled[:len(filled)-1]
+	if len(activity) == 0 {
+		return
+	}
+	r.parseActivity(activity[0], l)
+
+	// Watched videos have the channel on the following line
+	if r.Action == "Watched" && r.Title != "Google News" && len(activity) > 1 {
+		for _, seg := range activity[1] {
+			if seg.url != "" {
+				r.Channel = seg.text
+				r.ChannelURL = seg.url
+				break
+			}
+		}
+	}
+}
+
+// parseActivity finds the action phrase at the start or end of line. The item
+// is either the rest of the phrase's text or the link next to it.
+func (r *Result) parseActivity(line []segment, l *Locale) {
+	if len(line) == 0 {
+		return
+	}
+	first := line[0]
+	if first.url == "" {
+		action, rest, ok := l.matchPrefix(strings.TrimSpace(first.text))
+		if ok {
+			r.Action = action
+			if rest != "" {
+				r.Item = rest
+			} else if len(line) > 1 {
+				r.Item = line[1].text
+				r.URL = line[1].url
+			}
+			return
+		}
+	}
+
+	last := line[len(line)-1]
+	if last.url == "" {
+		action, rest, ok := l.matchSuffix(strings.TrimSpace(last.text))
+		if ok {
+			r.Action = action
+			if rest != "" {
+				r.Item = rest
+			} else if len(line) > 1 {
+				r.Item = line[len(line)-2].text
+				r.URL = line[len(line)-2].url
+			}
+		}
+	}
+}
+
+// formatDate renders the wall clock time of t, which keeps its own zone
+func formatDate(t time.Time) string {
+	return fmt.Sprintf("%02d-%02d-%02dT%02d:%02d:%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+}
+
+// parseActivityDate parses a date such as "Jan 6, 2020, 11:07:12 PM EST" in the
+// location its abbreviation maps to in zones or l, falling back to UTC
+func parseActivityDate(s string, l *Locale, zones map[string]*time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	loc := time.UTC
+	i := strings.LastIndex(s, " ")
+	if i > 0 {
+		zone, ok := zones[s[i+1:]]
+		if !ok {
+			zone, ok = l.zone(s[i+1:])
+		}
+		if ok {
+			loc = zone
+			s = s[:i]
+		}
+	}
+	if l != nil {
+		for _, layout := range l.DateLayouts {
+			t, err := time.ParseInLocation(layout, s, loc)
+			if err == nil {
+				return t, nil
+			}
 		}
+		s = l.translateMonths(s)
+	}
+	return dateparse.ParseIn(s, loc)
+}
 
+func (r *Result) addCaptionLine(section, text, link string) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return
+	}
+	switch section {
+	case "Products":
+		r.Products = append(r.Products, text)
+	case "Details":
+		r.Details = append(r.Details, text)
+	case "Locations":
+		loc := ActivityLocation{
+			Name: text,
+			URL:  link,
+		}
+		lat, lon, ok := parseMapsCoordinates(link)
+		if ok {
+			loc.Latitude = lat
+			loc.Longitude = lon
+		}
+		r.Locations = append(r.Locations, loc)
+	}
+}
+
+// parseMapsCoordinates pulls a latitude and longitude out of a Google Maps link
+// such as https://www.google.com/maps/@?api=1&map_action=map&center=40.7,-74.0
+func parseMapsCoordinates(link string) (float64, float64, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0, 0, false
+	}
+	q := u.Query()
+	for _, key := range []string{"center", "ll", "query", "q"} {
+		lat, lon, ok := parseLatLon(q.Get(key))
+		if ok {
+			return lat, lon, true
+		}
+	}
+	// Links of the form https://www.google.com/maps/@40.7,-74.0,12z
+	i := strings.Index(u.Path, "/@")
+	if i < 0 {
+		return 0, 0, false
+	}
+	parts := strings.Split(u.Path[i+2:], ",")
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	return parseLatLon(parts[0] + "," + parts[1])
+}
+
+func parseLatLon(s string) (float64, float64, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, false
 	}
+	return lat, lon, true
 }
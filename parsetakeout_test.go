@@ -1,7 +1,11 @@
 package ParseTakeout
 
 import (
+	"errors"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const testHome = "./test/"
@@ -24,3 +28,293 @@ func TestParseHTML(t *testing.T) {
 	// 	fmt.Println(result)
 	// }
 }
+
+func TestParseHTMLReader(t *testing.T) {
+	f, err := os.Open(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	count := 0
+	err = ParseHTMLReader(f, func(res Result) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := ParseHTML(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(results) {
+		t.Fatalf("Expected %d results, got %d", len(results), count)
+	}
+}
+
+func TestParseHTMLReaderStop(t *testing.T) {
+	f, err := os.Open(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	errStop := errors.New("stop")
+	count := 0
+	err = ParseHTMLReader(f, func(res Result) error {
+		count++
+		if count == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("Expected stop error, got %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 results before stopping, got %d", count)
+	}
+}
+
+func TestParseHTMLURL(t *testing.T) {
+	results, err := ParseHTML(testHome + "My-Activity-Developers.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("Expected results")
+	}
+
+	expected := "https://developers.google.com/dialogflow/pricing"
+	if results[0].URL != expected {
+		t.Fatalf("Expected URL %s, got %s", expected, results[0].URL)
+	}
+}
+
+func TestParseHTMLCaption(t *testing.T) {
+	doc := `<html><body><div class="outer-cell"><div class="mdl-grid">` +
+		`<div class="header-cell"><p class="mdl-typography--title">Search<br></p></div>` +
+		`<div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">Searched for <a href="https://www.google.com/search?q=golang">golang</a><br>Jan 6, 2020, 11:07:12 PM EST</div>` +
+		`<div class="content-cell mdl-cell mdl-cell--12-col mdl-typography--caption"><b>Products:</b><br>&emsp;Search<br>` +
+		`<b>Locations:</b><br>&emsp;At this general area: <a href="https://www.google.com/maps/@?api=1&amp;map_action=map&amp;center=40.712800,-74.006000&amp;zoom=12">From your device</a><br>` +
+		`<b>Details:</b><br>&emsp;From Google Ads<br></div></div></div></body></html>`
+
+	var results []Result
+	err := ParseHTMLReader(strings.NewReader(doc), func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+
+	res := results[0]
+	if len(res.Products) != 1 || res.Products[0] != "Search" {
+		t.Fatalf("Unexpected products %v", res.Products)
+	}
+	if len(res.Details) != 1 || res.Details[0] != "From Google Ads" {
+		t.Fatalf("Unexpected details %v", res.Details)
+	}
+	if len(res.Locations) != 1 {
+		t.Fatalf("Expected 1 location, got %d", len(res.Locations))
+	}
+	loc := res.Locations[0]
+	if loc.Name != "At this general area: From your device" {
+		t.Fatalf("Unexpected location name %s", loc.Name)
+	}
+	if loc.Latitude != 40.7128 || loc.Longitude != -74.006 {
+		t.Fatalf("Unexpected coordinates %f,%f", loc.Latitude, loc.Longitude)
+	}
+}
+
+func TestParseActivityDate(t *testing.T) {
+	d, err := parseActivityDate("Jan 6, 2020, 11:07:12 PM EST", English(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2020, 1, 7, 4, 7, 12, 0, time.UTC)
+	if !d.Equal(expected) {
+		t.Fatalf("Expected %v, got %v", expected, d)
+	}
+	if _, offset := d.Zone(); offset != -5*60*60 {
+		t.Fatalf("Expected offset of -5h, got %d", offset)
+	}
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	zones := map[string]*time.Location{"EST": ny}
+	d, err = parseActivityDate("Jul 4, 2019, 12:00:00 PM EST", English(), zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, offset := d.Zone(); offset != -4*60*60 {
+		t.Fatalf("Expected daylight offset of -4h, got %d", offset)
+	}
+	// Other abbreviations still use the defaults
+	d, err = parseActivityDate("Jul 4, 2019, 12:00:00 PM PST", English(), zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, offset := d.Zone(); offset != -8*60*60 {
+		t.Fatalf("Expected offset of -8h, got %d", offset)
+	}
+
+	doc := activityHTML("en", "Search", "Searched for&nbsp;<a href=\"https://www.google.com/search?q=x\">x</a><br>Jul 4, 2019, 12:00:00 PM EST", "")
+	res := parseOne(t, HTMLParser{Zones: zones}, doc)
+	if res.UTCOffset != -4*60*60 || res.Date != "2019-07-04T12:00:00" {
+		t.Fatalf("Expected the parser's zone to be used, got %+v", res)
+	}
+}
+
+func activityHTML(lang, title, content, caption string) string {
+	return `<html lang="` + lang + `"><head><title>My Activity</title></head><body>` +
+		`<div class="outer-cell mdl-cell mdl-cell--12-col mdl-shadow--2dp"><div class="mdl-grid">` +
+		`<div class="header-cell mdl-cell mdl-cell--12-col"><p class="mdl-typography--title">` + title + `<br></p></div>` +
+		`<div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1">` + content + `</div>` +
+		`<div class="content-cell mdl-cell mdl-cell--6-col mdl-typography--body-1 mdl-typography--text-right"></div>` +
+		`<div class="content-cell mdl-cell mdl-cell--12-col mdl-typography--caption">` + caption + `</div>` +
+		`</div></div></body></html>`
+}
+
+func parseOne(t *testing.T, p HTMLParser, doc string) Result {
+	var results []Result
+	err := p.Parse(strings.NewReader(doc), func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	return results[0]
+}
+
+func TestParseHTMLEmptyContent(t *testing.T) {
+	tests := []struct {
+		content string
+		action  string
+	}{
+		{``, ""},
+		{`<br>Watched&nbsp;<a href="https://www.youtube.com/watch?v=abc">A Video</a><br>Jan 6, 2020, 11:07:12 PM EST`, "Watched"},
+	}
+	for _, test := range tests {
+		var results []Result
+		err := ParseHTMLReader(strings.NewReader(activityHTML("", "YouTube", test.content, "")), func(res Result) error {
+			results = append(results, res)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Action != test.action {
+			t.Errorf("Expected one result with action %q for %q, got %+v", test.action, test.content, results)
+		}
+	}
+}
+
+func TestParseHTMLChannel(t *testing.T) {
+	doc := activityHTML("", "YouTube",
+		`Watched&nbsp;<a href="https://www.youtube.com/watch?v=abc">A Video</a><br><a href="https://www.youtube.com/channel/xyz">A Channel</a><br>Jan 6, 2020, 11:07:12 PM EST`,
+		`<b>Products:</b><br>&emsp;YouTube<br>`)
+
+	res := parseOne(t, HTMLParser{}, doc)
+	if res.Action != "Watched" || res.Item != "A Video" {
+		t.Fatalf("Unexpected result %v", res)
+	}
+	if res.Channel != "A Channel" || res.ChannelURL != "https://www.youtube.com/channel/xyz" {
+		t.Fatalf("Unexpected channel %s %s", res.Channel, res.ChannelURL)
+	}
+}
+
+func TestParseHTMLGerman(t *testing.T) {
+	doc := activityHTML("", "Suche",
+		`Gesucht nach&nbsp;<a href="https://www.google.com/search?q=wetter">wetter</a><br>06.01.2020, 23:07:12 MEZ`,
+		`<b>Produkte:</b><br>&emsp;Suche<br>`)
+
+	res := parseOne(t, HTMLParser{}, doc)
+	if res.Action != "Searched for" || res.Item != "wetter" {
+		t.Fatalf("Unexpected result %v", res)
+	}
+	if res.UnixTime != time.Date(2020, 1, 6, 22, 7, 12, 0, time.UTC).Unix() {
+		t.Fatalf("Unexpected date %s", res.Date)
+	}
+	if len(res.Products) != 1 || res.Products[0] != "Suche" {
+		t.Fatalf("Unexpected products %v", res.Products)
+	}
+}
+
+func TestParseHTMLSpanishMonths(t *testing.T) {
+	es, ok := GetLocale("es-ES")
+	if !ok {
+		t.Fatal("Expected es locale")
+	}
+	doc := activityHTML("", "YouTube",
+		`Has visto&nbsp;<a href="https://www.youtube.com/watch?v=abc">Un vídeo</a><br>6 ene 2020, 23:07:12 CET`,
+		`<b>Productos:</b><br>&emsp;YouTube<br>`)
+
+	res := parseOne(t, HTMLParser{Locale: es}, doc)
+	if res.Action != "Watched" || res.Item != "Un vídeo" {
+		t.Fatalf("Unexpected result %v", res)
+	}
+	if res.Date != "2020-01-06T23:07:12" {
+		t.Fatalf("Unexpected date %s", res.Date)
+	}
+}
+
+func TestRegisterLocaleMixedCase(t *testing.T) {
+	pt := &Locale{
+		Name:    "pt_BR",
+		Actions: map[string]string{"Pesquisou": "Searched for"},
+	}
+	RegisterLocale(pt)
+	defer func() {
+		delete(locales, "pt-br")
+		localeNames = localeNames[:len(localeNames)-1]
+	}()
+
+	for _, name := range []string{"pt_BR", "pt-BR", "PT-br"} {
+		if l, ok := GetLocale(name); !ok || l != pt {
+			t.Errorf("Expected %q to find the registered locale, got %v %v", name, l, ok)
+		}
+	}
+	if _, ok := GetLocale("pt"); ok {
+		t.Error("Expected no locale for \"pt\"")
+	}
+
+	// Registering it again under another case replaces it
+	again := &Locale{Name: "PT-BR", Actions: pt.Actions}
+	n := len(localeNames)
+	RegisterLocale(again)
+	if l, _ := GetLocale("pt-br"); l != again || len(localeNames) != n {
+		t.Errorf("Expected the locale to be replaced, got %v with %d names", l, len(localeNames))
+	}
+}
+
+func TestParseHTMLJapanese(t *testing.T) {
+	doc := activityHTML("ja", "検索",
+		`<a href="https://www.google.com/search?q=golang">golang</a> を検索しました<br>2020/01/06 23:07:12 JST`,
+		`<b>サービス:</b><br>&emsp;検索<br>`)
+
+	res := parseOne(t, HTMLParser{}, doc)
+	if res.Action != "Searched for" || res.Item != "golang" {
+		t.Fatalf("Unexpected result %v", res)
+	}
+	if res.URL != "https://www.google.com/search?q=golang" {
+		t.Fatalf("Unexpected URL %s", res.URL)
+	}
+	if res.UTCOffset != 9*60*60 {
+		t.Fatalf("Unexpected offset %d", res.UTCOffset)
+	}
+	if len(res.Products) != 1 {
+		t.Fatalf("Unexpected products %v", res.Products)
+	}
+}
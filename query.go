@@ -0,0 +1,259 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// queryPageSize is how many items an ItemIterator reads per query
+const queryPageSize = 500
+
+// SortOrder orders query results by time, then action and item
+type SortOrder int
+
+const (
+	// SortAscending returns the oldest items first
+	SortAscending SortOrder = iota
+	// SortDescending returns the newest items first
+	SortDescending
+)
+
+// Cursor marks an item in query order. A Query with After set resumes just
+// after it, which stays correct while items are inserted or deleted, unlike
+// an Offset.
+type Cursor struct {
+	UnixTime int64  `json:"unixtime"`
+	Action   string `json:"action"`
+	Item     string `json:"item"`
+}
+
+func (r Result) cursor() Cursor {
+	return Cursor{
+		UnixTime: r.UnixTime,
+		Action:   r.Action,
+		Item:     r.Item,
+	}
+}
+
+// Query selects items by every field that is set, matching any of the values
+// given for a list. Begin and End bound "unixtime" to [Begin, End) and are
+// ignored when zero, as is a Limit of zero.
+type Query struct {
+	Begin    int64
+	End      int64
+	Titles   []string
+	Actions  []string
+	Channels []string
+	Products []string
+	// Text matches items containing it literally
+	Text string
+
+	Limit  int
+	Offset int
+	After  *Cursor
+	Sort   SortOrder
+}
+
+// where builds the WHERE clause for the query, resuming after the cursor if
+// one is given
+func (q Query) where(after *Cursor) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg...)
+	}
+	addIn := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		for _, v := range values {
+			args = append(args, v)
+		}
+		conds = append(conds, `"`+column+`" IN (`+placeholders(len(values))+`)`)
+	}
+
+	if q.Begin != 0 {
+		add(`"unixtime" >= ?`, q.Begin)
+	}
+	if q.End != 0 {
+		add(`"unixtime" < ?`, q.End)
+	}
+	addIn("title", q.Titles)
+	addIn("action", q.Actions)
+	addIn("channel", q.Channels)
+	if len(q.Products) > 0 {
+		for _, product := range q.Products {
+			args = append(args, product)
+		}
+		conds = append(conds, `("action", "unixtime", "item") IN (
+		SELECT "action", "unixtime", "item" FROM "itemproducts" WHERE "product" IN (`+placeholders(len(q.Products))+`)
+	)`)
+	}
+	if q.Text != "" {
+		add(`"item" LIKE ? ESCAPE '\'`, likePattern(q.Text))
+	}
+	if after != nil {
+		op := ">"
+		if q.Sort == SortDescending {
+			op = "<"
+		}
+		add(`("unixtime", "action", "item") `+op+` (?, ?, ?)`, after.UnixTime, after.Action, after.Item)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return `
+	WHERE ` + strings.Join(conds, " AND "), args
+}
+
+// placeholders returns n comma separated parameters
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// page builds the clause selecting up to limit items after the cursor,
+// skipping offset of them
+func (q Query) page(after *Cursor, limit, offset int) (string, []interface{}, error) {
+	var dir string
+	switch q.Sort {
+	case SortAscending:
+		dir = "ASC"
+	case SortDescending:
+		dir = "DESC"
+	default:
+		return "", nil, fmt.Errorf("Invalid sort order %d", q.Sort)
+	}
+
+	where, args := q.where(after)
+	args = append(args, limit, offset)
+	return where + `
+	ORDER BY "unixtime" ` + dir + `, "action" ` + dir + `, "item" ` + dir + `
+	LIMIT ? OFFSET ?`, args, nil
+}
+
+// ItemIterator steps through the results of a Query, reading them a page at
+// a time:
+//
+//	it := IterateItems(db, q)
+//	for it.Next() {
+//		res := it.Result()
+//	}
+//	err := it.Err()
+//
+// Each page is a separate query, so no connection is held between calls.
+type ItemIterator struct {
+	ctx       context.Context
+	db        *sql.DB
+	query     Query
+	page      []Result
+	pos       int
+	after     *Cursor
+	offset    int
+	remaining int
+	done      bool
+	err       error
+}
+
+// IterateItems runs q against db
+func IterateItems(db *sql.DB, q Query) *ItemIterator {
+	return IterateItemsContext(context.Background(), db, q)
+}
+
+// IterateItemsContext runs q against db, reading each page under ctx
+func IterateItemsContext(ctx context.Context, db *sql.DB, q Query) *ItemIterator {
+	remaining := q.Limit
+	if remaining <= 0 {
+		remaining = -1
+	}
+	return &ItemIterator{
+		ctx:       ctx,
+		db:        db,
+		query:     q,
+		pos:       -1,
+		after:     q.After,
+		offset:    q.Offset,
+		remaining: remaining,
+	}
+}
+
+// Next advances to the next result, returning false when there are no more
+// or an error stopped the query
+func (it *ItemIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.pos+1 < len(it.page) {
+		it.pos++
+		return true
+	}
+	if it.done || it.remaining == 0 {
+		return false
+	}
+
+	size := queryPageSize
+	if it.remaining > 0 && it.remaining < size {
+		size = it.remaining
+	}
+	clause, args, err := it.query.page(it.after, size, it.offset)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	page, err := queryItems(it.ctx, it.db, clause, args...)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.offset = 0
+	if it.remaining > 0 {
+		it.remaining -= len(page)
+	}
+	if len(page) < size {
+		it.done = true
+	}
+	if len(page) == 0 {
+		return false
+	}
+	last := page[len(page)-1].cursor()
+	it.after = &last
+	it.page = page
+	it.pos = 0
+	return true
+}
+
+// Result is the item Next advanced to
+func (it *ItemIterator) Result() Result {
+	return it.page[it.pos]
+}
+
+// Cursor marks the item Next advanced to, for a later Query to resume after
+func (it *ItemIterator) Cursor() Cursor {
+	return it.page[it.pos].cursor()
+}
+
+// Err is the error that stopped the query, if any
+func (it *ItemIterator) Err() error {
+	return it.err
+}
+
+// GetItems returns every result of q
+func GetItems(db *sql.DB, q Query) ([]Result, error) {
+	return GetItemsContext(context.Background(), db, q)
+}
+
+// GetItemsContext is GetItems, stopped when ctx is done
+func GetItemsContext(ctx context.Context, db *sql.DB, q Query) ([]Result, error) {
+	results := []Result{}
+	it := IterateItemsContext(ctx, db, q)
+	for it.Next() {
+		results = append(results, it.Result())
+	}
+	return results, it.Err()
+}
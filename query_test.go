@@ -0,0 +1,123 @@
+package ParseTakeout
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestQueryItems(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	items := func(results []Result) string {
+		found := []string{}
+		for _, r := range results {
+			found = append(found, r.Item)
+		}
+		return strings.Join(found, "|")
+	}
+	cases := []struct {
+		query Query
+		want  string
+	}{
+		{Query{}, "golang|sqlite 100%|golang talk|cats"},
+		{Query{Sort: SortDescending}, "cats|golang talk|sqlite 100%|golang"},
+		{Query{Begin: 200, End: 300}, "sqlite 100%|golang talk"},
+		{Query{Titles: []string{"YouTube"}}, "golang talk|cats"},
+		{Query{Actions: []string{"Searched for", "Watched"}, Text: "golang"}, "golang|golang talk"},
+		{Query{Products: []string{"Search"}}, "golang|sqlite 100%"},
+		{Query{Channels: []string{"none"}}, ""},
+		{Query{Text: "100%"}, "sqlite 100%"},
+		{Query{Limit: 2, Offset: 1}, "sqlite 100%|golang talk"},
+		{Query{After: &Cursor{UnixTime: 200, Action: "Searched for", Item: "sqlite 100%"}}, "golang talk|cats"},
+		{Query{After: &Cursor{UnixTime: 200, Action: "Searched for", Item: "sqlite 100%"}, Sort: SortDescending}, "golang"},
+	}
+	for _, c := range cases {
+		results, err := GetItems(db, c.query)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.query, err)
+		}
+		if got := items(results); got != c.want {
+			t.Errorf("%+v: got %q, expected %q", c.query, got, c.want)
+		}
+	}
+
+	results, err := GetItems(db, Query{Titles: []string{"YouTube"}, Text: "cats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Products) != 1 || len(results[0].Details) != 1 {
+		t.Errorf("Expected cats with its product and detail, got %v", results)
+	}
+
+	_, err = GetItems(db, Query{Sort: SortOrder(5)})
+	if err == nil {
+		t.Error("Expected an invalid sort order to fail")
+	}
+}
+
+func TestIterateItemsPages(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	w := NewWriter(db, 0)
+	for i := 0; i < 2*queryPageSize+10; i++ {
+		err := w.InsertItem(Result{Title: "Paged", Action: "Viewed", Item: fmt.Sprint("page ", i), Date: "d", UnixTime: int64(1000 + i/3), Details: []string{fmt.Sprint("detail ", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the items in chunks, resuming from the cursor each time
+	q := Query{Titles: []string{"Paged"}, Limit: queryPageSize - 1}
+	seen := map[string]bool{}
+	for {
+		it := IterateItems(db, q)
+		n := 0
+		var prev int64
+		for it.Next() {
+			res := it.Result()
+			if res.UnixTime < prev {
+				t.Fatalf("Out of order: %d after %d", res.UnixTime, prev)
+			}
+			prev = res.UnixTime
+			if seen[res.Item] {
+				t.Fatalf("%s seen twice", res.Item)
+			}
+			// Pages are bigger than a batch of details, which must all be attached
+			if len(res.Details) != 1 || res.Details[0] != "detail "+strings.TrimPrefix(res.Item, "page ") {
+				t.Fatalf("Unexpected details %v of %s", res.Details, res.Item)
+			}
+			seen[res.Item] = true
+			cursor := it.Cursor()
+			q.After = &cursor
+			n++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if len(seen) != 2*queryPageSize+10 {
+		t.Fatalf("Expected %d items, got %d", 2*queryPageSize+10, len(seen))
+	}
+
+	results, err := GetItems(db, Query{Titles: []string{"Paged"}, Offset: queryPageSize + 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != queryPageSize+5 {
+		t.Fatalf("Expected %d items, got %d", queryPageSize+5, len(results))
+	}
+	for _, res := range results {
+		if len(res.Details) != 1 {
+			t.Fatalf("Expected one detail of %s, got %v", res.Item, res.Details)
+		}
+	}
+}
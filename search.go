@@ -0,0 +1,274 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrSearchUnavailable is returned by Search when SQLite was built without
+// FTS5. Build with -tags sqlite_fts5 to enable it.
+var ErrSearchUnavailable = errors.New("Full text search needs SQLite built with FTS5 (-tags sqlite_fts5)")
+
+// SearchOptions narrows a Search with the same fields as DeleteItems, and
+// pages through the results
+type SearchOptions struct {
+	ItemFilter
+	// Limit defaults to 20
+	Limit  int
+	Offset int
+	// HighlightStart and HighlightEnd surround matches in the snippet and
+	// default to "<b>" and "</b>"
+	HighlightStart string
+	HighlightEnd   string
+}
+
+// SearchResult is an item matching a Search, best match first
+type SearchResult struct {
+	Result
+	Snippet string `json:"snippet"`
+	// Rank is the bm25 score, lower is better
+	Rank float64 `json:"rank"`
+}
+
+func searchAvailable(ctx context.Context, db *sql.DB) (bool, error) {
+	var used bool
+	err := db.QueryRowContext(ctx, `SELECT sqlite_compileoption_used('ENABLE_FTS5');`).Scan(&used)
+	return used, err
+}
+
+// searchTriggers keep "itemsearch" in sync with "items" and "itemdetails"
+var searchTriggers = []string{
+	"itemsearch_insert",
+	"itemsearch_update",
+	"itemsearch_delete",
+	"itemsearch_details_insert",
+	"itemsearch_details_delete",
+}
+
+// ensureSearchIndex creates the "itemsearch" FTS5 table and the triggers that
+// keep it in sync with "items" and "itemdetails", filling it from the items
+// already stored. It is not a migration as it depends on how SQLite was built,
+// so a database gains its index the first time it is opened with FTS5.
+//
+// Without FTS5 the triggers would fail every insert, so they are dropped and
+// the index is refilled when the database is next opened with FTS5.
+//
+// The index is keyed by the rowid of "items", which VACUUM may renumber.
+// RebuildSearchIndex repairs it afterwards.
+func ensureSearchIndex(ctx context.Context, db *sql.DB) error {
+	ok, err := searchAvailable(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	var triggers int
+	err = db.QueryRowContext(ctx, `
+	SELECT COUNT(*) FROM "sqlite_master" WHERE "type" = 'trigger' AND "name" = 'itemsearch_insert';
+	`).Scan(&triggers)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if triggers == 0 {
+			return nil
+		}
+		for _, trigger := range searchTriggers {
+			_, err := db.ExecContext(ctx, `DROP TRIGGER IF EXISTS "`+trigger+`";`)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if triggers > 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = execAll(tx, `
+	CREATE VIRTUAL TABLE IF NOT EXISTS "itemsearch" USING fts5("title", "item", "channel", "details");
+	`, `
+	CREATE TRIGGER "itemsearch_insert" AFTER INSERT ON "items" BEGIN
+		INSERT INTO "itemsearch" ("rowid", "title", "item", "channel", "details")
+		VALUES (new."rowid", new."title", new."item", new."channel", `+itemDetailsText("new")+`);
+	END;
+	`, `
+	CREATE TRIGGER "itemsearch_update" AFTER UPDATE ON "items" BEGIN
+		DELETE FROM "itemsearch" WHERE "rowid" = old."rowid";
+		INSERT INTO "itemsearch" ("rowid", "title", "item", "channel", "details")
+		VALUES (new."rowid", new."title", new."item", new."channel", `+itemDetailsText("new")+`);
+	END;
+	`, `
+	CREATE TRIGGER "itemsearch_delete" AFTER DELETE ON "items" BEGIN
+		DELETE FROM "itemsearch" WHERE "rowid" = old."rowid";
+	END;
+	`, `
+	CREATE TRIGGER "itemsearch_details_insert" AFTER INSERT ON "itemdetails" BEGIN
+		UPDATE "itemsearch" SET "details" = `+itemDetailsText("new")+`
+		WHERE "rowid" = (
+			SELECT "rowid" FROM "items"
+			WHERE "action" = new."action" AND "unixtime" = new."unixtime" AND "item" = new."item"
+		);
+	END;
+	`, `
+	CREATE TRIGGER "itemsearch_details_delete" AFTER DELETE ON "itemdetails" BEGIN
+		UPDATE "itemsearch" SET "details" = `+itemDetailsText("old")+`
+		WHERE "rowid" = (
+			SELECT "rowid" FROM "items"
+			WHERE "action" = old."action" AND "unixtime" = old."unixtime" AND "item" = old."item"
+		);
+	END;
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = fillSearchIndex(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// itemDetailsText is the SQL for the details of the item in row, joined for
+// indexing
+func itemDetailsText(row string) string {
+	return `(
+			SELECT group_concat("detail", ' ') FROM "itemdetails"
+			WHERE "action" = ` + row + `."action" AND "unixtime" = ` + row + `."unixtime" AND "item" = ` + row + `."item"
+		)`
+}
+
+func fillSearchIndex(tx *sql.Tx) error {
+	return execAll(tx, `
+	DELETE FROM "itemsearch";
+	`, `
+	INSERT INTO "itemsearch" ("rowid", "title", "item", "channel", "details")
+	SELECT "rowid", "title", "item", "channel", `+itemDetailsText(`"items"`)+`
+	FROM "items";
+	`)
+}
+
+// RebuildSearchIndex refills the search index from "items", e.g. after a
+// VACUUM
+func RebuildSearchIndex(db *sql.DB) error {
+	return RebuildSearchIndexContext(context.Background(), db)
+}
+
+// RebuildSearchIndexContext is RebuildSearchIndex, stopped when ctx is done
+func RebuildSearchIndexContext(ctx context.Context, db *sql.DB) error {
+	ok, err := searchAvailable(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSearchUnavailable
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fillSearchIndex(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Search finds items whose title, item, channel or details match query, best
+// match first. The query uses FTS5 syntax: "quoted phrases", prefix*, AND, OR,
+// NOT and parentheses, and column filters such as channel:name.
+func Search(db *sql.DB, query string, opts SearchOptions) ([]SearchResult, error) {
+	return SearchContext(context.Background(), db, query, opts)
+}
+
+// SearchContext is Search, stopped when ctx is done
+func SearchContext(ctx context.Context, db *sql.DB, query string, opts SearchOptions) ([]SearchResult, error) {
+	ok, err := searchAvailable(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrSearchUnavailable
+	}
+
+	if opts.Limit <= 0 {
+		opts.Limit = 20
+	}
+	if opts.HighlightStart == "" && opts.HighlightEnd == "" {
+		opts.HighlightStart, opts.HighlightEnd = "<b>", "</b>"
+	}
+
+	// The filter only sees "items", whose columns share names with the index
+	where, filterArgs := opts.ItemFilter.where()
+	args := []interface{}{opts.HighlightStart, opts.HighlightEnd}
+	args = append(args, filterArgs...)
+	args = append(args, query, opts.Limit, opts.Offset)
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT i."title", i."action", i."item", i."channel", i."date", i."unixtime", i."url", i."channelurl", i."utcoffset",
+		snippet("itemsearch", -1, ?, ?, '…', 12), bm25("itemsearch")
+	FROM "itemsearch"
+	JOIN (SELECT "rowid" AS "itemrowid", * FROM "items" `+where+`) AS i
+	ON i."itemrowid" = "itemsearch"."rowid"
+	WHERE "itemsearch" MATCH ?
+	ORDER BY bm25("itemsearch") ASC, i."unixtime" DESC
+	LIMIT ? OFFSET ?;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		var link, channelLink sql.NullString
+		var offset sql.NullInt64
+		if err := rows.Scan(&r.Title, &r.Action, &r.Item, &r.Channel, &r.Date, &r.UnixTime, &link, &channelLink, &offset, &r.Snippet, &r.Rank); err != nil {
+			return nil, err
+		}
+		r.URL = link.String
+		r.ChannelURL = channelLink.String
+		r.UTCOffset = int(offset.Int64)
+		results = append(results, r)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return results, attachSearchDetails(ctx, db, results)
+}
+
+// attachSearchDetails fills in the products, details and locations of a page
+// of search results by their keys
+func attachSearchDetails(ctx context.Context, db *sql.DB, results []SearchResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	items := make([]Result, len(results))
+	for i, r := range results {
+		items[i] = r.Result
+	}
+
+	err := attachItemDetails(ctx, db, items)
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		results[i].Result = items[i]
+	}
+	return nil
+}
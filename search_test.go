@@ -0,0 +1,131 @@
+package ParseTakeout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Search needs FTS5, run with: go test -tags sqlite_fts5
+func TestSearch(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	if ok, err := searchAvailable(context.Background(), db); err != nil || !ok {
+		if _, err := Search(db, "golang", SearchOptions{}); err != ErrSearchUnavailable {
+			t.Fatalf("Expected ErrSearchUnavailable without FTS5, got %v", err)
+		}
+		t.Skip("SQLite built without FTS5")
+	}
+
+	items := func(results []SearchResult) []string {
+		found := []string{}
+		for _, r := range results {
+			found = append(found, r.Item)
+		}
+		return found
+	}
+	cases := []struct {
+		query string
+		opts  SearchOptions
+		want  []string
+	}{
+		{"golang", SearchOptions{}, []string{"golang", "golang talk"}},
+		{`"golang talk"`, SearchOptions{}, []string{"golang talk"}},
+		{"gol*", SearchOptions{}, []string{"golang", "golang talk"}},
+		{"golang NOT talk", SearchOptions{}, []string{"golang"}},
+		{"cats OR sqlite", SearchOptions{}, []string{"cats", "sqlite 100%"}},
+		{"ads", SearchOptions{}, []string{"cats"}},
+		{"golang", SearchOptions{ItemFilter: ItemFilter{Product: "YouTube"}}, []string{"golang talk"}},
+		{"golang", SearchOptions{ItemFilter: ItemFilter{Begin: 150}}, []string{"golang talk"}},
+		{"golang", SearchOptions{Limit: 1, Offset: 1}, []string{"golang talk"}},
+	}
+	for _, c := range cases {
+		results, err := Search(db, c.query, c.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		got := items(results)
+		if len(c.want) == 2 && len(got) == 2 && got[0] == c.want[1] {
+			// Order between equally ranked hits is by time, not the case order
+			got[0], got[1] = got[1], got[0]
+		}
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: got %q, expected %q", c.query, got, c.want)
+		}
+	}
+
+	results, err := Search(db, "cats", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Snippet != "<b>cats</b>" || len(results[0].Details) != 1 {
+		t.Errorf("Unexpected result %+v", results)
+	}
+
+	if _, err := DeleteItems(db, ItemFilter{Item: "cats"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertItem(db, Result{Title: "Search", Action: "Searched for", Item: "golang generics", Date: "d", UnixTime: 400}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildSearchIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]int{"cats": 0, "ads": 0, "generics": 1} {
+		results, err := Search(db, query, SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != want {
+			t.Errorf("%s: got %d results, expected %d", query, len(results), want)
+		}
+	}
+
+	// Upserted items are indexed with their details, new or replaced
+	w := NewWriter(db, 0)
+	res := Result{Title: "Search", Action: "Searched for", Item: "pets", Date: "d", UnixTime: 500, Details: []string{"kittens"}}
+	if _, err := w.UpsertItem(res); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	res.Details = []string{"puppies"}
+	if _, err := w.UpsertItem(res); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]int{"kittens": 0, "puppies": 1, "pets": 1} {
+		results, err := Search(db, query, SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != want {
+			t.Errorf("%s: got %d results, expected %d", query, len(results), want)
+		}
+	}
+}
+
+// BenchmarkUpsertItemsSearchIndex upserts growing numbers of items with the
+// search index kept up to date by triggers. The time per item should stay
+// about the same as the tables grow. Run with: go test -tags sqlite_fts5
+func BenchmarkUpsertItemsSearchIndex(b *testing.B) {
+	db, cleanup := openWriterBenchDB(b)
+	ok, err := searchAvailable(context.Background(), db)
+	cleanup()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ok {
+		b.Skip("SQLite built without FTS5")
+	}
+	for _, n := range []int{5000, 20000, 80000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkUpsertItems(b, n)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store keeps items and location points and summarises them. SQLiteStore
+// is the database the rest of the package works on; MemoryStore holds
+// everything in memory for tests and short lived tools.
+type Store interface {
+	// InsertItem fails if an item with the same action, time and item is
+	// already stored
+	InsertItem(ctx context.Context, res Result) error
+	// InsertLocation fails if a point with the same time and coordinates is
+	// already stored
+	InsertLocation(ctx context.Context, loc Location) error
+
+	GetItems(ctx context.Context, q Query) ([]Result, error)
+	// GetLocations returns the points in [begin, end) by time, then latitude
+	// and longitude. Zero leaves that end of the range open.
+	GetLocations(ctx context.Context, begin, end int64) ([]Location, error)
+
+	DeleteItems(ctx context.Context, filter ItemFilter) (int64, error)
+	DeleteLocation(ctx context.Context, loc Location) error
+
+	GetYears(ctx context.Context, loc *time.Location) ([]int, error)
+	GetSummaryofYear(ctx context.Context, year int, loc *time.Location) (*YearlySummary, error)
+	GetTotalSummary(ctx context.Context, loc *time.Location) (*TotalSummary, error)
+
+	Close() error
+}
+
+// SQLiteStore is a Store over a database opened by OpenDB
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// OpenSQLiteStore opens the database at dbPath, migrating it as OpenDB does
+func OpenSQLiteStore(dbPath string) (*SQLiteStore, error) {
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLiteStore(db), nil
+}
+
+// DB is the database behind the store, for the functions Store doesn't cover
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) InsertItem(ctx context.Context, res Result) error {
+	return InsertItemContext(ctx, s.db, res)
+}
+
+func (s *SQLiteStore) InsertLocation(ctx context.Context, loc Location) error {
+	return InsertLocationContext(ctx, s.db, loc)
+}
+
+func (s *SQLiteStore) GetItems(ctx context.Context, q Query) ([]Result, error) {
+	return GetItemsContext(ctx, s.db, q)
+}
+
+func (s *SQLiteStore) GetLocations(ctx context.Context, begin, end int64) ([]Location, error) {
+	where := `
+	WHERE 1`
+	args := []interface{}{}
+	if begin != 0 {
+		where += ` AND "unixtime" >= ?`
+		args = append(args, begin)
+	}
+	if end != 0 {
+		where += ` AND "unixtime" < ?`
+		args = append(args, end)
+	}
+	return queryLocations(ctx, s.db, where+`
+	ORDER BY "unixtime" ASC, "latitude" ASC, "longitude" ASC`, args...)
+}
+
+func (s *SQLiteStore) DeleteItems(ctx context.Context, filter ItemFilter) (int64, error) {
+	return DeleteItemsContext(ctx, s.db, filter)
+}
+
+func (s *SQLiteStore) DeleteLocation(ctx context.Context, loc Location) error {
+	return DeleteLocationContext(ctx, s.db, loc)
+}
+
+func (s *SQLiteStore) GetYears(ctx context.Context, loc *time.Location) ([]int, error) {
+	return GetYearsContext(ctx, s.db, loc)
+}
+
+func (s *SQLiteStore) GetSummaryofYear(ctx context.Context, year int, loc *time.Location) (*YearlySummary, error) {
+	return GetSummaryofYearContext(ctx, s.db, year, loc)
+}
+
+func (s *SQLiteStore) GetTotalSummary(ctx context.Context, loc *time.Location) (*TotalSummary, error) {
+	return GetTotalSummaryContext(ctx, s.db, loc)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
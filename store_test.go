@@ -0,0 +1,338 @@
+package ParseTakeout
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(year int, month time.Month, day int) int64 {
+	return time.Date(year, month, day, 12, 0, 0, 0, time.UTC).Unix()
+}
+
+var storeItems = []Result{
+	{Title: "Search", Action: "Searched for", Item: "golang", Date: "d", UnixTime: at(2018, 1, 1), Products: []string{"Search"}},
+	{Title: "Search", Action: "Searched for", Item: "golang", Date: "d", UnixTime: at(2018, 1, 2), Products: []string{"Search"}},
+	{Title: "Search", Action: "Searched for", Item: "golang", Date: "d", UnixTime: at(2018, 3, 1), Products: []string{"Search"}},
+	{Title: "Search", Action: "Searched for", Item: "SQLite", Date: "d", UnixTime: at(2018, 3, 2), Products: []string{"Search"}, Details: []string{"From Google Ads"}},
+	{Title: "Search", Action: "Searched for", Item: "SQLite", Date: "d", UnixTime: at(2018, 6, 1), Products: []string{"Search"}},
+	{Title: "YouTube", Action: "Watched", Item: "cats", Channel: "Cat TV", Date: "d", UnixTime: at(2018, 6, 2), Products: []string{"YouTube"},
+		Locations: []ActivityLocation{{Name: "Home", URL: "https://maps.google.com", Latitude: 1.5, Longitude: 2.5}}},
+	{Title: "YouTube", Action: "Watched", Item: "dogs", Channel: "Dog TV", Date: "d", UnixTime: at(2019, 2, 1), Products: []string{"YouTube"}},
+	{Title: "YouTube", Action: "Watched", Item: "dogs", Channel: "Dog TV", Date: "d", UnixTime: at(2019, 2, 2), Products: []string{"YouTube"}},
+	{Title: "YouTube", Action: "Watched", Item: "dogs", Channel: "Dog TV", Date: "d", UnixTime: at(2019, 5, 1), Products: []string{"YouTube"}},
+	{Title: "Search", Action: "Searched for", Item: "golang", Date: "d", UnixTime: at(2019, 5, 2), Products: []string{"Search"}},
+}
+
+var storeLocations = []Location{
+	{Unixtime: at(2018, 1, 1), Latitude: 10, Longitude: 20, Accuracy: 5,
+		Activities: []LocationActivity{{Unixtime: at(2018, 1, 1), Type: "STILL", Confidence: 40}, {Unixtime: at(2018, 1, 1), Type: "WALKING", Confidence: 60}}},
+	{Unixtime: at(2018, 1, 1), Latitude: 11, Longitude: 21},
+	{Unixtime: at(2018, 7, 1), Latitude: 12, Longitude: 22, Source: "WIFI"},
+	{Unixtime: at(2019, 1, 1), Latitude: 13, Longitude: 23,
+		Activities: []LocationActivity{{Unixtime: at(2019, 1, 1), Type: "IN_VEHICLE", Confidence: 90}}},
+}
+
+func fillStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	for _, res := range storeItems {
+		if err := s.InsertItem(ctx, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, loc := range storeLocations {
+		if err := s.InsertLocation(ctx, loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testStore is the behaviour every Store shares
+func testStore(t *testing.T, open func(t *testing.T) Store) {
+	ctx := context.Background()
+
+	t.Run("Insert", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+		fillStore(t, s)
+
+		if err := s.InsertItem(ctx, storeItems[0]); err == nil {
+			t.Error("Expected inserting a stored item to fail")
+		}
+		if err := s.InsertLocation(ctx, storeLocations[0]); err == nil {
+			t.Error("Expected inserting a stored point to fail")
+		}
+	})
+
+	t.Run("GetItems", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+		fillStore(t, s)
+
+		cases := []struct {
+			query Query
+			want  string
+		}{
+			{Query{Actions: []string{"Watched"}}, "cats|dogs|dogs|dogs"},
+			{Query{Channels: []string{"Cat TV"}, Sort: SortDescending}, "cats"},
+			{Query{Begin: at(2018, 6, 1), End: at(2019, 2, 2)}, "SQLite|cats|dogs"},
+			{Query{Text: "sqlite"}, "SQLite|SQLite"},
+			{Query{Products: []string{"YouTube"}, Limit: 2, Offset: 1}, "dogs|dogs"},
+			{Query{After: &Cursor{UnixTime: at(2019, 2, 2), Action: "Watched", Item: "dogs"}}, "dogs|golang"},
+			{Query{Titles: []string{"Search"}, Sort: SortDescending, Limit: 2}, "golang|SQLite"},
+			{Query{Titles: []string{"Maps"}}, ""},
+		}
+		for _, c := range cases {
+			results, err := s.GetItems(ctx, c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := []string{}
+			for _, res := range results {
+				found = append(found, res.Item)
+			}
+			if got := strings.Join(found, "|"); got != c.want {
+				t.Errorf("%+v: got %q, expected %q", c.query, got, c.want)
+			}
+		}
+
+		results, err := s.GetItems(ctx, Query{Text: "cats"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0], storeItems[5]) {
+			t.Errorf("Expected %v, got %v", storeItems[5], results)
+		}
+
+		if _, err := s.GetItems(ctx, Query{Sort: SortOrder(9)}); err == nil {
+			t.Error("Expected an invalid sort order to fail")
+		}
+	})
+
+	t.Run("GetLocations", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+		fillStore(t, s)
+
+		locations, err := s.GetLocations(ctx, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locations) != 4 {
+			t.Fatalf("Expected 4 points, got %d", len(locations))
+		}
+		// Points at the same time keep their own activities, best guess first
+		if len(locations[0].Activities) != 2 || locations[0].Activities[0].Type != "WALKING" {
+			t.Errorf("Expected WALKING then STILL, got %v", locations[0].Activities)
+		}
+		if locations[1].Activities != nil {
+			t.Errorf("Expected no activities, got %v", locations[1].Activities)
+		}
+		if locations[2].Source != "WIFI" || locations[2].Activities != nil {
+			t.Errorf("Unexpected point %v", locations[2])
+		}
+
+		locations, err = s.GetLocations(ctx, at(2018, 7, 1), at(2019, 1, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locations) != 1 || locations[0].Latitude != 12 {
+			t.Errorf("Expected the July 2018 point, got %v", locations)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+		fillStore(t, s)
+
+		if _, err := s.DeleteItems(ctx, ItemFilter{}); err == nil {
+			t.Error("Expected an empty filter to be refused")
+		}
+		n, err := s.DeleteItems(ctx, ItemFilter{Product: "YouTube", Begin: at(2019, 1, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("Expected 3 items deleted, got %d", n)
+		}
+		n, err = s.DeleteItems(ctx, ItemFilter{Search: "QL"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("Expected 2 items deleted, got %d", n)
+		}
+		results, err := s.GetItems(ctx, Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 5 {
+			t.Errorf("Expected 5 items left, got %d", len(results))
+		}
+
+		// Deleting a point leaves the activities of another at the same time
+		jan := at(2018, 1, 1)
+		if err := s.DeleteLocation(ctx, storeLocations[1]); err != nil {
+			t.Fatal(err)
+		}
+		locations, err := s.GetLocations(ctx, jan, jan+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locations) != 1 || locations[0].Latitude != 10 || len(locations[0].Activities) != 2 {
+			t.Fatalf("Expected the other point with its activities, got %v", locations)
+		}
+		if err := s.DeleteLocation(ctx, storeLocations[0]); err != nil {
+			t.Fatal(err)
+		}
+		bare := storeLocations[0]
+		bare.Activities = nil
+		if err := s.InsertLocation(ctx, bare); err != nil {
+			t.Fatal(err)
+		}
+		locations, err = s.GetLocations(ctx, jan, jan+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locations) != 1 || locations[0].Activities != nil {
+			t.Errorf("Expected the activities to be gone, got %v", locations)
+		}
+		if err := s.InsertLocation(ctx, bare); err == nil {
+			t.Error("Expected inserting the point again to fail")
+		}
+	})
+
+	t.Run("Summaries", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+
+		years, err := s.GetYears(ctx, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(years) != 0 {
+			t.Errorf("Expected no years when empty, got %v", years)
+		}
+
+		fillStore(t, s)
+		years, err = s.GetYears(ctx, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(years, []int{2018, 2019}) {
+			t.Errorf("Expected 2018 and 2019, got %v", years)
+		}
+
+		sum, err := s.GetSummaryofYear(ctx, 2018, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum.Total != 6 || sum.YoutubeTotal != 1 || len(sum.LocationData) != 3 {
+			t.Errorf("Unexpected 2018 summary %+v", sum)
+		}
+		wantCommon := []ItemFreq{{"golang", 3}, {"SQLite", 2}, {"cats", 1}}
+		if !reflect.DeepEqual(sum.MostCommon, wantCommon) {
+			t.Errorf("Expected %v, got %v", wantCommon, sum.MostCommon)
+		}
+		if !reflect.DeepEqual(sum.ChannelCommon, []ChannelFreq{{"Cat TV", 1}}) {
+			t.Errorf("Unexpected channels %v", sum.ChannelCommon)
+		}
+		monthly := []int{}
+		for _, m := range sum.Monthly {
+			monthly = append(monthly, m.Total)
+		}
+		if !reflect.DeepEqual(monthly, []int{2, 0, 2, 0, 0, 2, 0, 0, 0, 0, 0, 0}) {
+			t.Errorf("Unexpected monthly totals %v", monthly)
+		}
+
+		total, err := s.GetTotalSummary(ctx, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Total != 10 || total.YoutubeTotal != 4 || len(total.Yearly) != 2 || len(total.LocationData) != 4 {
+			t.Errorf("Unexpected total summary %+v", total)
+		}
+		wantCommon = []ItemFreq{{"golang", 4}, {"dogs", 3}, {"SQLite", 2}, {"cats", 1}}
+		if !reflect.DeepEqual(total.MostCommon, wantCommon) {
+			t.Errorf("Expected %v, got %v", wantCommon, total.MostCommon)
+		}
+		if !reflect.DeepEqual(total.ChannelCommon, []ChannelFreq{{"Dog TV", 3}, {"Cat TV", 1}}) {
+			t.Errorf("Unexpected channels %v", total.ChannelCommon)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		s := open(t)
+		defer s.Close()
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := s.InsertItem(cancelled, storeItems[0]); err == nil {
+			t.Error("Expected a cancelled insert to fail")
+		}
+		if _, err := s.GetTotalSummary(cancelled, time.UTC); err == nil {
+			t.Error("Expected a cancelled summary to fail")
+		}
+	})
+}
+
+func openTestSQLiteStore(t *testing.T) Store {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSQLiteStore(filepath.Join(dir, "store.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	// The directory goes once the store is closed
+	return removeOnClose{s, dir}
+}
+
+type removeOnClose struct {
+	Store
+	dir string
+}
+
+func (s removeOnClose) Close() error {
+	err := s.Store.Close()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, openTestSQLiteStore)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestStoresAgree(t *testing.T) {
+	sqlite := openTestSQLiteStore(t)
+	defer sqlite.Close()
+	memory := NewMemoryStore()
+	fillStore(t, sqlite)
+	fillStore(t, memory)
+
+	summaries := []*TotalSummary{}
+	for _, s := range []Store{sqlite, memory} {
+		sum, err := s.GetTotalSummary(context.Background(), time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries = append(summaries, sum)
+	}
+	if !reflect.DeepEqual(summaries[0], summaries[1]) {
+		t.Errorf("Summaries differ:\n%+v\n%+v", summaries[0], summaries[1])
+	}
+}
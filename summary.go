@@ -0,0 +1,345 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SummaryOptions chooses what goes into a summary
+type SummaryOptions struct {
+	// Locations fills in LocationData with every point. The points are read
+	// once and shared by the total and yearly summaries; leave them out and
+	// page through GetLocationPage when there are too many to hold.
+	Locations bool
+}
+
+// yearRange is a year with its first and last second in some location
+type yearRange struct {
+	year  int
+	begin int64
+	end   int64
+}
+
+func yearRanges(years []int, loc *time.Location) []yearRange {
+	ranges := make([]yearRange, len(years))
+	for i, year := range years {
+		begin, end := calculateUnixRangeOfYear(year, loc)
+		ranges[i] = yearRange{year: year, begin: begin, end: end}
+	}
+	return ranges
+}
+
+// valuesTable is a WITH clause naming rows of integers. They are computed
+// here rather than given by callers, so they are written into the SQL to stay
+// clear of the limit on parameters however many years there are.
+func valuesTable(name string, columns []string, rows [][]int64) string {
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		cells := make([]string, len(row))
+		for j, v := range row {
+			cells[j] = fmt.Sprint(v)
+		}
+		values[i] = "(" + strings.Join(cells, ", ") + ")"
+	}
+	return `WITH "` + name + `" ("` + strings.Join(columns, `", "`) + `") AS (VALUES ` + strings.Join(values, ", ") + `)`
+}
+
+func yearsTable(ranges []yearRange) string {
+	rows := make([][]int64, len(ranges))
+	for i, r := range ranges {
+		rows[i] = []int64{int64(r.year), r.begin, r.end}
+	}
+	return valuesTable("years", []string{"year", "begin", "end"}, rows)
+}
+
+// summarizeMonths counts the items in every month of the years, along with
+// how many of each year's items have a channel, in one query
+func summarizeMonths(ctx context.Context, db queryer, ranges []yearRange, loc *time.Location) (map[int][]MonthSummary, map[int]int, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	months := map[int][]MonthSummary{}
+	youtube := map[int]int{}
+	if len(ranges) == 0 {
+		return months, youtube, nil
+	}
+
+	rows := [][]int64{}
+	for _, r := range ranges {
+		for month := time.January; month <= time.December; month++ {
+			begin := time.Date(r.year, month, 1, 0, 0, 0, 0, loc).Unix()
+			end := time.Date(r.year, month+1, 1, 0, 0, 0, 0, loc).Unix() - 1
+			rows = append(rows, []int64{int64(r.year), int64(month), begin, end})
+		}
+	}
+
+	counts, err := db.QueryContext(ctx, valuesTable("months", []string{"year", "month", "begin", "end"}, rows)+`
+	SELECT m."year", m."month", m."begin", m."end", COUNT(i."unixtime"), COUNT(NULLIF(i."channel", ''))
+	FROM "months" AS m LEFT JOIN "items" AS i ON i."unixtime" BETWEEN m."begin" AND m."end"
+	GROUP BY m."year", m."month"
+	ORDER BY m."year", m."month";
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer counts.Close()
+
+	for counts.Next() {
+		var year, channels int
+		var month time.Month
+		var sum MonthSummary
+		if err := counts.Scan(&year, &month, &sum.Begin, &sum.End, &sum.Total, &channels); err != nil {
+			return nil, nil, err
+		}
+		sum.Name = month.String()
+		months[year] = append(months[year], sum)
+		youtube[year] += channels
+	}
+	// Check for errors from iterating over rows.
+	if err := counts.Err(); err != nil {
+		return nil, nil, err
+	}
+	return months, youtube, nil
+}
+
+// topPlacesByYear finds the 10 places visited most in each year
+func topPlacesByYear(ctx context.Context, db queryer, ranges []yearRange) (map[int][]PlaceFreq, error) {
+	top := map[int][]PlaceFreq{}
+	if len(ranges) == 0 {
+		return top, nil
+	}
+
+	rows, err := db.QueryContext(ctx, yearsTable(ranges)+`
+	SELECT "year", "name", "address", "placeid", "count", "duration" FROM (
+		SELECT y."year", v."name", v."address", v."placeid", COUNT(*) AS "count", SUM(v."endtime" - v."starttime") AS "duration",
+			ROW_NUMBER() OVER (
+				PARTITION BY y."year"
+				ORDER BY COUNT(*) DESC, SUM(v."endtime" - v."starttime") DESC, v."placeid" ASC, v."name" ASC
+			) AS "rank"
+		FROM "years" AS y JOIN "placevisits" AS v ON v."starttime" BETWEEN y."begin" AND y."end"
+		GROUP BY y."year", v."placeid", v."name", v."address"
+	) WHERE "rank" <= 10
+	ORDER BY "year", "rank";
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var year int
+		var p PlaceFreq
+		if err := rows.Scan(&year, &p.Name, &p.Address, &p.PlaceID, &p.Count, &p.Duration); err != nil {
+			return nil, err
+		}
+		top[year] = append(top[year], p)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return top, nil
+}
+
+// distanceByYear totals the distance covered by each activity in each year
+func distanceByYear(ctx context.Context, db queryer, ranges []yearRange) (map[int][]ActivityDistance, error) {
+	distances := map[int][]ActivityDistance{}
+	if len(ranges) == 0 {
+		return distances, nil
+	}
+
+	rows, err := db.QueryContext(ctx, yearsTable(ranges)+`
+	SELECT y."year", s."activitytype", SUM(s."distance"), COUNT(*)
+	FROM "years" AS y JOIN "activitysegments" AS s ON s."starttime" BETWEEN y."begin" AND y."end"
+	GROUP BY y."year", s."activitytype"
+	ORDER BY y."year", SUM(s."distance") DESC, s."activitytype" ASC;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var year int
+		var d ActivityDistance
+		if err := rows.Scan(&year, &d.ActivityType, &d.Distance, &d.Count); err != nil {
+			return nil, err
+		}
+		distances[year] = append(distances[year], d)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return distances, nil
+}
+
+// locationsBetween returns the points of locations, sorted by time, from
+// begin to end inclusive. They share the backing array of locations.
+func locationsBetween(locations []Location, begin, end int64) []Location {
+	first := sort.Search(len(locations), func(i int) bool {
+		return locations[i].Unixtime >= begin
+	})
+	last := sort.Search(len(locations), func(i int) bool {
+		return locations[i].Unixtime > end
+	})
+	return locations[first:last:last]
+}
+
+// summarizeYears builds the summaries of years with a fixed number of grouped
+// queries however many years there are, leaving out LocationData
+func summarizeYears(ctx context.Context, db queryer, ranges []yearRange, loc *time.Location) ([]YearlySummary, error) {
+	months, youtube, err := summarizeMonths(ctx, db, ranges, loc)
+	if err != nil {
+		return nil, err
+	}
+	items, err := topByYear(ctx, db, GroupByItem, summaryTop, ranges)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := topByYear(ctx, db, GroupByChannel, summaryTop, ranges)
+	if err != nil {
+		return nil, err
+	}
+	places, err := topPlacesByYear(ctx, db, ranges)
+	if err != nil {
+		return nil, err
+	}
+	distances, err := distanceByYear(ctx, db, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	var sums []YearlySummary
+	for _, r := range ranges {
+		total := 0
+		for _, month := range months[r.year] {
+			total += month.Total
+		}
+		sums = append(sums, YearlySummary{
+			Year:          r.year,
+			Monthly:       months[r.year],
+			MostCommon:    itemFreqs(items[r.year]),
+			ChannelCommon: channelFreqs(channels[r.year]),
+			Total:         total,
+			YoutubeTotal:  youtube[r.year],
+
+			TopPlaces:          places[r.year],
+			DistanceByActivity: distances[r.year],
+		})
+	}
+	return sums, nil
+}
+
+// summarizeTotal builds the total summary from the summaries of every year,
+// leaving out LocationData
+func summarizeTotal(ctx context.Context, db queryer, yearSums []YearlySummary) (*TotalSummary, error) {
+	mostCommon, err := getMostCommonItem(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	channelCommon, err := getMostCommonChannel(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// The years run from the first item to the last, so they hold them all
+	total, youtubeTotal := 0, 0
+	for _, sum := range yearSums {
+		total += sum.Total
+		youtubeTotal += sum.YoutubeTotal
+	}
+
+	return &TotalSummary{
+		MostCommon:    mostCommon,
+		YoutubeTotal:  youtubeTotal,
+		ChannelCommon: channelCommon,
+		Total:         total,
+		Yearly:        yearSums,
+	}, nil
+}
+
+// GetLocationPage returns up to limit points from begin to end inclusive, by
+// time, then latitude and longitude, starting after the point after if given.
+// Zero leaves that end of the range open, and a limit of zero returns every
+// point.
+func GetLocationPage(db *sql.DB, begin, end int64, after *Location, limit int) ([]Location, error) {
+	return GetLocationPageContext(context.Background(), db, begin, end, after, limit)
+}
+
+// GetLocationPageContext is GetLocationPage, stopped when ctx is done
+func GetLocationPageContext(ctx context.Context, db *sql.DB, begin, end int64, after *Location, limit int) ([]Location, error) {
+	var conds []string
+	var args []interface{}
+	if begin != 0 {
+		conds = append(conds, `"unixtime" >= ?`)
+		args = append(args, begin)
+	}
+	if end != 0 {
+		conds = append(conds, `"unixtime" <= ?`)
+		args = append(args, end)
+	}
+	if after != nil {
+		conds = append(conds, `("unixtime", "latitude", "longitude") > (?, ?, ?)`)
+		args = append(args, after.Unixtime, after.Latitude, after.Longitude)
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = `
+	WHERE ` + strings.Join(conds, " AND ")
+	}
+	where += `
+	ORDER BY "unixtime" ASC, "latitude" ASC, "longitude" ASC`
+	if limit > 0 {
+		where += `
+	LIMIT ?`
+		args = append(args, limit)
+	}
+	return queryLocations(ctx, db, where, args...)
+}
+
+// GetSummaryofYearWithOptions summarises year as GetSummaryofYear does,
+// including only what opts asks for
+func GetSummaryofYearWithOptions(ctx context.Context, db *sql.DB, year int, loc *time.Location, opts SummaryOptions) (*YearlySummary, error) {
+	sums, err := cachedYearSummaries(ctx, db, []int{year}, loc)
+	if err != nil {
+		return nil, err
+	}
+	sum := &sums[0]
+
+	if opts.Locations {
+		sum.LocationData, err = getAllLocationsForYear(ctx, db, year, loc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sum, nil
+}
+
+// GetTotalSummaryWithOptions summarises every year as GetTotalSummary does,
+// including only what opts asks for
+func GetTotalSummaryWithOptions(ctx context.Context, db *sql.DB, loc *time.Location, opts SummaryOptions) (*TotalSummary, error) {
+	sum, err := cachedTotalSummary(ctx, db, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Locations {
+		sum.LocationData, err = GetLocationPageContext(ctx, db, 0, 0, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sum.Yearly {
+			begin, end := calculateUnixRangeOfYear(sum.Yearly[i].Year, loc)
+			sum.Yearly[i].LocationData = locationsBetween(sum.LocationData, begin, end)
+		}
+	}
+	return sum, nil
+}
@@ -0,0 +1,355 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openSummaryBenchDB fills a database with years of items and points spread
+// evenly from 2005
+func openSummaryBenchDB(b *testing.B, years, perYear int) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := OpenDB(filepath.Join(dir, "bench.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+
+	w := NewWriter(db, 0)
+	start := time.Date(2005, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	step := int64(365*24*60*60) / int64(perYear)
+	for i := 0; i < years*perYear; i++ {
+		t := start + int64(i)*step
+		res := Result{
+			Title:  "Search",
+			Action: "Searched for",
+			Item:   fmt.Sprint("query ", i%500),
+			Date:   "d",
+		}
+		if i%3 == 0 {
+			res.Title, res.Action, res.Channel = "YouTube", "Watched", fmt.Sprint("channel ", i%50)
+		}
+		res.UnixTime = t
+		if err := w.InsertItem(res); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.InsertLocation(Location{Unixtime: t, Latitude: int64(i), Longitude: int64(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// BenchmarkSummarizeYears builds every yearly summary and the total without
+// the cache, as GetTotalSummary does when every year is stale
+func BenchmarkSummarizeYears(b *testing.B) {
+	db, cleanup := openSummaryBenchDB(b, 15, 2000)
+	defer cleanup()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		years, err := getYears(ctx, db, time.UTC)
+		if err != nil {
+			b.Fatal(err)
+		}
+		yearSums, err := summarizeYears(ctx, db, yearRanges(years, time.UTC), time.UTC)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sum, err := summarizeTotal(ctx, db, yearSums)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if sum.Total != 15*2000 {
+			b.Fatalf("Expected %d items, got %d", 15*2000, sum.Total)
+		}
+	}
+}
+
+// countItemsPerYear is a COUNT(*) of items as the summaries before grouped
+// queries ran it, once per year or month
+func countItemsPerYear(ctx context.Context, db *sql.DB, where string, args ...interface{}) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM "items" `+where+`;`, args...).Scan(&n)
+	return n, err
+}
+
+// summarizeYearPerYear builds the summary of year the way summaries were
+// built before grouped queries, with a query per month and per statistic
+func summarizeYearPerYear(ctx context.Context, db *sql.DB, year int, loc *time.Location) (YearlySummary, error) {
+	sum := YearlySummary{Year: year}
+	for month := time.January; month <= time.December; month++ {
+		begin := time.Date(year, month, 1, 0, 0, 0, 0, loc).Unix()
+		end := time.Date(year, month+1, 1, 0, 0, 0, 0, loc).Unix() - 1
+		n, err := countItemsPerYear(ctx, db, `WHERE "unixtime" >= ? AND "unixtime" <= ?`, begin, end)
+		if err != nil {
+			return sum, err
+		}
+		sum.Monthly = append(sum.Monthly, MonthSummary{Name: month.String(), Begin: begin, End: end, Total: n})
+	}
+
+	begin, end := calculateUnixRangeOfYear(year, loc)
+	var err error
+	sum.Total, err = countItemsPerYear(ctx, db, `WHERE "unixtime" >= ? AND "unixtime" <= ?`, begin, end)
+	if err != nil {
+		return sum, err
+	}
+	sum.YoutubeTotal, err = countItemsPerYear(ctx, db, `WHERE "unixtime" >= ? AND "unixtime" <= ? AND "channel" != ''`, begin, end)
+	if err != nil {
+		return sum, err
+	}
+	for _, column := range []string{"item", "channel"} {
+		rows, err := db.QueryContext(ctx, `
+		SELECT "`+column+`", COUNT(*) FROM "items"
+		WHERE "unixtime" >= ? AND "unixtime" <= ? AND "`+column+`" != ''
+		GROUP BY "`+column+`"
+		ORDER BY COUNT(*) DESC
+		LIMIT 10;
+		`, begin, end)
+		if err != nil {
+			return sum, err
+		}
+		for rows.Next() {
+			var freq ItemFreq
+			if err := rows.Scan(&freq.Name, &freq.Count); err != nil {
+				rows.Close()
+				return sum, err
+			}
+			if column == "item" {
+				sum.MostCommon = append(sum.MostCommon, freq)
+			} else {
+				sum.ChannelCommon = append(sum.ChannelCommon, ChannelFreq(freq))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return sum, err
+		}
+	}
+
+	ranges := yearRanges([]int{year}, loc)
+	places, err := topPlacesByYear(ctx, db, ranges)
+	if err != nil {
+		return sum, err
+	}
+	distances, err := distanceByYear(ctx, db, ranges)
+	if err != nil {
+		return sum, err
+	}
+	sum.TopPlaces, sum.DistanceByActivity = places[year], distances[year]
+	return sum, nil
+}
+
+// BenchmarkSummarizeYearsPerYear is BenchmarkSummarizeYears with the queries
+// per year and month that summaries ran before, to compare against. They ran
+// without the index on items by time, so they are timed with and without it.
+func BenchmarkSummarizeYearsPerYear(b *testing.B) {
+	b.Run("unindexed", func(b *testing.B) { benchmarkSummarizeYearsPerYear(b, false) })
+	b.Run("indexed", func(b *testing.B) { benchmarkSummarizeYearsPerYear(b, true) })
+}
+
+func benchmarkSummarizeYearsPerYear(b *testing.B, indexed bool) {
+	db, cleanup := openSummaryBenchDB(b, 15, 2000)
+	defer cleanup()
+	ctx := context.Background()
+	if !indexed {
+		if _, err := db.Exec(`DROP INDEX "items_unixtime";`); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		years, err := getYears(ctx, db, time.UTC)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var yearSums []YearlySummary
+		for _, year := range years {
+			sum, err := summarizeYearPerYear(ctx, db, year, time.UTC)
+			if err != nil {
+				b.Fatal(err)
+			}
+			yearSums = append(yearSums, sum)
+		}
+		sum, err := summarizeTotal(ctx, db, yearSums)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if sum.Total != 15*2000 {
+			b.Fatalf("Expected %d items, got %d", 15*2000, sum.Total)
+		}
+	}
+}
+
+// BenchmarkGetTotalSummary reads the cached summary, along with every point
+func BenchmarkGetTotalSummary(b *testing.B) {
+	db, cleanup := openSummaryBenchDB(b, 15, 2000)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sum, err := GetTotalSummary(db, time.UTC)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if sum.Total != 15*2000 {
+			b.Fatalf("Expected %d items, got %d", 15*2000, sum.Total)
+		}
+	}
+}
+
+// BenchmarkGetTotalSummaryWithoutLocations reads only the cached summary
+func BenchmarkGetTotalSummaryWithoutLocations(b *testing.B) {
+	db, cleanup := openSummaryBenchDB(b, 15, 2000)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetTotalSummaryWithOptions(context.Background(), db, time.UTC, SummaryOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetLocationPage(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var got []Location
+	var after *Location
+	for {
+		page, err := GetLocationPageContext(ctx, db, 0, 0, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		got = append(got, page...)
+		after = &page[len(page)-1]
+	}
+	all, err := GetLocationPage(db, 0, 0, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, all) || len(all) != 3 {
+		t.Errorf("Pages %+v don't match %+v", got, all)
+	}
+
+	page, err := GetLocationPage(db, 200, 200, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Latitude != 1 || page[1].Latitude != 2 {
+		t.Errorf("Expected the two points at 200, got %+v", page)
+	}
+}
+
+func TestGetTotalSummaryWithOptions(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	full, err := GetTotalSummaryContext(ctx, db, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Total != 4 || len(full.LocationData) != 3 || len(full.Yearly) != 1 || len(full.Yearly[0].LocationData) != 3 {
+		t.Errorf("Unexpected summary %+v", full)
+	}
+
+	bare, err := GetTotalSummaryWithOptions(ctx, db, time.UTC, SummaryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bare.LocationData != nil || bare.Yearly[0].LocationData != nil {
+		t.Errorf("Expected no locations, got %+v", bare)
+	}
+	full.LocationData, full.Yearly[0].LocationData = nil, nil
+	if !reflect.DeepEqual(full, bare) {
+		t.Errorf("Summaries differ:\n%+v\n%+v", full, bare)
+	}
+}
+
+func TestSummarizeYears(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := InsertItem(db, Result{Title: "YouTube", Action: "Watched", Item: "cats", Channel: "Cat TV", Date: "d", UnixTime: 400}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertPlaceVisit(db, PlaceVisit{StartTime: 100, EndTime: 160, PlaceID: "p", Name: "Home"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertActivitySegment(db, ActivitySegment{StartTime: 200, EndTime: 260, Distance: 500, ActivityType: "WALKING"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := summarizeYears(ctx, db, yearRanges([]int{1970, 1971}, time.UTC), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 || sums[0].Year != 1970 || sums[1].Year != 1971 {
+		t.Fatalf("Expected summaries of 1970 and 1971, got %+v", sums)
+	}
+	got := sums[0]
+	// Only items with a channel count as YouTube videos
+	if got.Total != 5 || got.YoutubeTotal != 1 {
+		t.Errorf("Expected 5 items and 1 video, got %d and %d", got.Total, got.YoutubeTotal)
+	}
+	if len(got.Monthly) != 12 || got.Monthly[0].Name != "January" || got.Monthly[0].Total != 5 || got.Monthly[1].Total != 0 {
+		t.Errorf("Expected every item in January, got %+v", got.Monthly)
+	}
+	wantItems := []ItemFreq{{"cats", 2}, {"golang", 1}, {"golang talk", 1}, {"sqlite 100%", 1}}
+	if !reflect.DeepEqual(got.MostCommon, wantItems) {
+		t.Errorf("Expected most common %+v, got %+v", wantItems, got.MostCommon)
+	}
+	if want := []ChannelFreq{{"Cat TV", 1}}; !reflect.DeepEqual(got.ChannelCommon, want) {
+		t.Errorf("Expected channels %+v, got %+v", want, got.ChannelCommon)
+	}
+	if want := []PlaceFreq{{Name: "Home", Count: 1, Duration: 100}, {Name: "Home", PlaceID: "p", Count: 1, Duration: 60}}; !reflect.DeepEqual(got.TopPlaces, want) {
+		t.Errorf("Expected places %+v, got %+v", want, got.TopPlaces)
+	}
+	if want := []ActivityDistance{{"WALKING", 500, 1}, {"", 0, 1}}; !reflect.DeepEqual(got.DistanceByActivity, want) {
+		t.Errorf("Expected distances %+v, got %+v", want, got.DistanceByActivity)
+	}
+
+	empty := sums[1]
+	if empty.Total != 0 || empty.MostCommon != nil || empty.TopPlaces != nil || len(empty.Monthly) != 12 {
+		t.Errorf("Expected an empty 1971, got %+v", empty)
+	}
+
+	// GetSummaryofYear gives the same summary, with the year's points
+	year, err := GetSummaryofYear(db, 1970, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(year.LocationData) != 3 {
+		t.Errorf("Expected 3 points in 1970, got %+v", year.LocationData)
+	}
+	year.LocationData = nil
+	if !reflect.DeepEqual(*year, got) {
+		t.Errorf("GetSummaryofYear = %+v, expected %+v", *year, got)
+	}
+}
@@ -0,0 +1,431 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Summaries are cached per time zone in "summarytotals", "summaryyears" and
+// "summarymonths", without their LocationData. Triggers mark a cached summary
+// stale when rows it was built from change, and stale summaries are built
+// again the next time they are asked for or after an import.
+
+// summaryZone names loc in the cache. Zones sharing a name are told apart by
+// the range of each year, which is stored and compared on every read.
+func summaryZone(loc *time.Location) string {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return loc.String()
+}
+
+// marshalSummaryFields encodes the lists of a summary, each in its own column
+func marshalSummaryFields(fields ...interface{}) ([]interface{}, error) {
+	encoded := make([]interface{}, len(fields))
+	for i, field := range fields {
+		b, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = string(b)
+	}
+	return encoded, nil
+}
+
+func unmarshalSummaryFields(encoded []string, fields ...interface{}) error {
+	for i, field := range fields {
+		if err := json.Unmarshal([]byte(encoded[i]), field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadYearSummaries returns the fresh cached summaries of zone whose years
+// cover the same range as in ranges
+func loadYearSummaries(ctx context.Context, db queryer, zone string, ranges []yearRange) (map[int]*YearlySummary, error) {
+	wanted := map[int]yearRange{}
+	for _, r := range ranges {
+		wanted[r.year] = r
+	}
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT "year", "begin", "end", "total", "youtubetotal", "mostcommon", "channelcommon", "topplaces", "distancebyactivity"
+	FROM "summaryyears"
+	WHERE "zone" = ? AND "stale" = 0;
+	`, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[int]*YearlySummary{}
+	for rows.Next() {
+		var sum YearlySummary
+		var begin, end int64
+		encoded := make([]string, 4)
+		if err := rows.Scan(&sum.Year, &begin, &end, &sum.Total, &sum.YoutubeTotal, &encoded[0], &encoded[1], &encoded[2], &encoded[3]); err != nil {
+			return nil, err
+		}
+		if r, ok := wanted[sum.Year]; !ok || r.begin != begin || r.end != end {
+			continue
+		}
+		err := unmarshalSummaryFields(encoded, &sum.MostCommon, &sum.ChannelCommon, &sum.TopPlaces, &sum.DistanceByActivity)
+		if err != nil {
+			return nil, err
+		}
+		sums[sum.Year] = &sum
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(sums) == 0 {
+		return sums, nil
+	}
+
+	months, err := db.QueryContext(ctx, `
+	SELECT "year", "month", "begin", "end", "total"
+	FROM "summarymonths"
+	WHERE "zone" = ?
+	ORDER BY "year" ASC, "month" ASC;
+	`, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer months.Close()
+
+	for months.Next() {
+		var year int
+		var month time.Month
+		var m MonthSummary
+		if err := months.Scan(&year, &month, &m.Begin, &m.End, &m.Total); err != nil {
+			return nil, err
+		}
+		if sum, ok := sums[year]; ok {
+			m.Name = month.String()
+			sum.Monthly = append(sum.Monthly, m)
+		}
+	}
+	// Check for errors from iterating over rows.
+	if err := months.Err(); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+func storeYearSummaries(ctx context.Context, tx *sql.Tx, zone string, ranges []yearRange, sums []YearlySummary) error {
+	for i, sum := range sums {
+		r := ranges[i]
+		encoded, err := marshalSummaryFields(sum.MostCommon, sum.ChannelCommon, sum.TopPlaces, sum.DistanceByActivity)
+		if err != nil {
+			return err
+		}
+		args := append([]interface{}{zone, r.year, r.begin, r.end, sum.Total, sum.YoutubeTotal}, encoded...)
+		_, err = tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO "summaryyears" ("zone", "year", "begin", "end", "stale", "total", "youtubetotal", "mostcommon", "channelcommon", "topplaces", "distancebyactivity")
+		VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?);
+		`, args...)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+		DELETE FROM "summarymonths" WHERE "zone" = ? AND "year" = ?;
+		`, zone, r.year)
+		if err != nil {
+			return err
+		}
+		for j, m := range sum.Monthly {
+			_, err := tx.ExecContext(ctx, `
+			INSERT INTO "summarymonths" ("zone", "year", "month", "begin", "end", "total")
+			VALUES (?, ?, ?, ?, ?, ?);
+			`, zone, r.year, j+1, m.Begin, m.End, m.Total)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropStaleSummaries deletes the stale summaries of zone. Being the first
+// write of a transaction, it also keeps other writers out until the fresh
+// ones are stored.
+func dropStaleSummaries(ctx context.Context, tx *sql.Tx, zone string) error {
+	for _, stmt := range []string{`
+	DELETE FROM "summarymonths" WHERE "zone" = ?1 AND "year" IN (
+		SELECT "year" FROM "summaryyears" WHERE "zone" = ?1 AND "stale" = 1
+	);
+	`, `
+	DELETE FROM "summaryyears" WHERE "zone" = ? AND "stale" = 1;
+	`, `
+	DELETE FROM "summarytotals" WHERE "zone" = ? AND "stale" = 1;
+	`} {
+		if _, err := tx.ExecContext(ctx, stmt, zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yearSummaries returns the summaries of the years in ranges, building and
+// caching those that aren't cached
+func yearSummaries(ctx context.Context, tx *sql.Tx, zone string, ranges []yearRange, loc *time.Location) ([]YearlySummary, error) {
+	cached, err := loadYearSummaries(ctx, tx, zone, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []yearRange
+	for _, r := range ranges {
+		if cached[r.year] == nil {
+			missing = append(missing, r)
+		}
+	}
+	built, err := summarizeYears(ctx, tx, missing, loc)
+	if err != nil {
+		return nil, err
+	}
+	err = storeYearSummaries(ctx, tx, zone, missing, built)
+	if err != nil {
+		return nil, err
+	}
+	for i := range built {
+		cached[built[i].Year] = &built[i]
+	}
+
+	sums := make([]YearlySummary, len(ranges))
+	for i, r := range ranges {
+		sums[i] = *cached[r.year]
+	}
+	return sums, nil
+}
+
+// cachedYearSummaries returns the summaries of years from the cache, building
+// those that are stale or missing
+func cachedYearSummaries(ctx context.Context, db *sql.DB, years []int, loc *time.Location) ([]YearlySummary, error) {
+	zone := summaryZone(loc)
+	ranges := yearRanges(years, loc)
+
+	cached, err := loadYearSummaries(ctx, db, zone, ranges)
+	if err != nil {
+		return nil, err
+	}
+	if len(cached) == len(ranges) {
+		sums := make([]YearlySummary, len(ranges))
+		for i, r := range ranges {
+			sums[i] = *cached[r.year]
+		}
+		return sums, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = dropStaleSummaries(ctx, tx, zone)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	sums, err := yearSummaries(ctx, tx, zone, ranges, loc)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return sums, tx.Commit()
+}
+
+// loadTotalSummary returns the fresh cached total summary of zone, or nil if
+// there isn't one
+func loadTotalSummary(ctx context.Context, db queryer, zone string, loc *time.Location) (*TotalSummary, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "years", "total", "youtubetotal", "mostcommon", "channelcommon"
+	FROM "summarytotals"
+	WHERE "zone" = ? AND "stale" = 0;
+	`, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sum *TotalSummary
+	var years []int
+	for rows.Next() {
+		sum = &TotalSummary{}
+		encoded := make([]string, 3)
+		if err := rows.Scan(&encoded[0], &sum.Total, &sum.YoutubeTotal, &encoded[1], &encoded[2]); err != nil {
+			return nil, err
+		}
+		if err := unmarshalSummaryFields(encoded, &years, &sum.MostCommon, &sum.ChannelCommon); err != nil {
+			return nil, err
+		}
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if sum == nil {
+		return nil, nil
+	}
+
+	ranges := yearRanges(years, loc)
+	cached, err := loadYearSummaries(ctx, db, zone, ranges)
+	if err != nil {
+		return nil, err
+	}
+	if len(cached) != len(ranges) {
+		return nil, nil
+	}
+	for _, r := range ranges {
+		sum.Yearly = append(sum.Yearly, *cached[r.year])
+	}
+	return sum, nil
+}
+
+// buildTotalSummary builds the total summary of zone and the summaries of
+// its years that aren't cached, caching them all
+func buildTotalSummary(ctx context.Context, db *sql.DB, zone string, loc *time.Location) (*TotalSummary, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := buildTotalSummaryTx(ctx, tx, zone, loc)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return sum, tx.Commit()
+}
+
+func buildTotalSummaryTx(ctx context.Context, tx *sql.Tx, zone string, loc *time.Location) (*TotalSummary, error) {
+	err := dropStaleSummaries(ctx, tx, zone)
+	if err != nil {
+		return nil, err
+	}
+	years, err := getYears(ctx, tx, loc)
+	if err != nil {
+		return nil, err
+	}
+	yearSums, err := yearSummaries(ctx, tx, zone, yearRanges(years, loc), loc)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := summarizeTotal(ctx, tx, yearSums)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := marshalSummaryFields(years, sum.MostCommon, sum.ChannelCommon)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+	INSERT OR REPLACE INTO "summarytotals" ("zone", "stale", "years", "total", "youtubetotal", "mostcommon", "channelcommon")
+	VALUES (?, 0, ?, ?, ?, ?, ?);
+	`, zone, encoded[0], sum.Total, sum.YoutubeTotal, encoded[1], encoded[2])
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// cachedTotalSummary returns the total summary from the cache, building it if
+// it is stale or missing
+func cachedTotalSummary(ctx context.Context, db *sql.DB, loc *time.Location) (*TotalSummary, error) {
+	zone := summaryZone(loc)
+	sum, err := loadTotalSummary(ctx, db, zone, loc)
+	if err != nil || sum != nil {
+		return sum, err
+	}
+	return buildTotalSummary(ctx, db, zone, loc)
+}
+
+// RebuildSummaries throws away the cached summaries of loc and builds the
+// total summary and those of every year again
+func RebuildSummaries(db *sql.DB, loc *time.Location) error {
+	return RebuildSummariesContext(context.Background(), db, loc)
+}
+
+// RebuildSummariesContext is RebuildSummaries, stopped when ctx is done
+func RebuildSummariesContext(ctx context.Context, db *sql.DB, loc *time.Location) error {
+	zone := summaryZone(loc)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"summarymonths", "summaryyears", "summarytotals"} {
+		_, err := tx.ExecContext(ctx, `DELETE FROM "`+table+`" WHERE "zone" = ?;`, zone)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = buildTotalSummaryTx(ctx, tx, zone, loc)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// refreshSummaries builds again the stale summaries of every zone that can
+// be loaded by name, so they are ready when next asked for
+func refreshSummaries(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+	SELECT "zone", NULL FROM "summarytotals" WHERE "stale" = 1
+	UNION
+	SELECT "zone", "year" FROM "summaryyears" WHERE "stale" = 1 AND "zone" NOT IN (
+		SELECT "zone" FROM "summarytotals"
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	totals := []string{}
+	years := map[string][]int{}
+	for rows.Next() {
+		var zone string
+		var year sql.NullInt64
+		if err := rows.Scan(&zone, &year); err != nil {
+			rows.Close()
+			return err
+		}
+		if year.Valid {
+			years[zone] = append(years[zone], int(year.Int64))
+		} else {
+			totals = append(totals, zone)
+		}
+	}
+	rows.Close()
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, zone := range totals {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			// Zones made with time.FixedZone are built when next asked for
+			continue
+		}
+		if _, err := buildTotalSummary(ctx, db, zone, loc); err != nil {
+			return err
+		}
+	}
+	for zone, zoneYears := range years {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			continue
+		}
+		if _, err := cachedYearSummaries(ctx, db, zoneYears, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
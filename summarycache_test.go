@@ -0,0 +1,201 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func staleSummaries(t *testing.T, db *sql.DB) (bool, map[int]bool) {
+	var total bool
+	err := db.QueryRow(`SELECT "stale" FROM "summarytotals" WHERE "zone" = 'UTC';`).Scan(&total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query(`SELECT "year", "stale" FROM "summaryyears" WHERE "zone" = 'UTC';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	years := map[int]bool{}
+	for rows.Next() {
+		var year int
+		var stale bool
+		if err := rows.Scan(&year, &stale); err != nil {
+			t.Fatal(err)
+		}
+		years[year] = stale
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return total, years
+}
+
+// checkCachedSummary compares the cached total summary with one built afresh
+func checkCachedSummary(t *testing.T, db *sql.DB) *TotalSummary {
+	t.Helper()
+	cached, err := GetTotalSummary(db, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	years, err := getYears(context.Background(), tx, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yearSums, err := summarizeYears(context.Background(), tx, yearRanges(years, time.UTC), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := summarizeTotal(context.Background(), tx, yearSums)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached.LocationData = nil
+	for i := range cached.Yearly {
+		cached.Yearly[i].LocationData = nil
+	}
+	if !reflect.DeepEqual(cached, built) {
+		t.Errorf("Cached summary differs:\n%+v\n%+v", cached, built)
+	}
+	return cached
+}
+
+func TestSummaryCacheInvalidation(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	late := time.Date(1972, 6, 1, 0, 0, 0, 0, time.UTC).Unix()
+	if err := InsertItem(db, Result{Title: "Search", Action: "Searched for", Item: "late", Date: "d", UnixTime: late}); err != nil {
+		t.Fatal(err)
+	}
+	if sum := checkCachedSummary(t, db); sum.Total != 5 || len(sum.Yearly) != 3 {
+		t.Fatalf("Unexpected summary %+v", sum)
+	}
+	total, years := staleSummaries(t, db)
+	if total || !reflect.DeepEqual(years, map[int]bool{1970: false, 1971: false, 1972: false}) {
+		t.Fatalf("Expected a fresh cache, got %v %v", total, years)
+	}
+
+	if err := InsertItem(db, Result{Title: "YouTube", Action: "Watched", Item: "later", Channel: "c", Date: "d", UnixTime: late + 1}); err != nil {
+		t.Fatal(err)
+	}
+	total, years = staleSummaries(t, db)
+	if !total || !reflect.DeepEqual(years, map[int]bool{1970: false, 1971: false, 1972: true}) {
+		t.Errorf("Expected only the total and 1972 to be stale, got %v %v", total, years)
+	}
+	if sum := checkCachedSummary(t, db); sum.Total != 6 || sum.YoutubeTotal != 1 {
+		t.Errorf("Unexpected summary %+v", sum)
+	}
+
+	if _, err := DeleteItems(db, ItemFilter{End: 101}); err != nil {
+		t.Fatal(err)
+	}
+	total, years = staleSummaries(t, db)
+	if !total || !reflect.DeepEqual(years, map[int]bool{1970: true, 1971: false, 1972: false}) {
+		t.Errorf("Expected only the total and 1970 to be stale, got %v %v", total, years)
+	}
+	if sum := checkCachedSummary(t, db); sum.Total != 5 {
+		t.Errorf("Unexpected summary %+v", sum)
+	}
+
+	// Visits are summarised too, but locations aren't cached
+	if err := InsertPlaceVisit(db, PlaceVisit{StartTime: late, EndTime: late + 60, Name: "Work"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertLocation(db, Location{Unixtime: 100, Latitude: 9, Longitude: 9}); err != nil {
+		t.Fatal(err)
+	}
+	total, years = staleSummaries(t, db)
+	if !total || !reflect.DeepEqual(years, map[int]bool{1970: false, 1971: false, 1972: true}) {
+		t.Errorf("Expected only the total and 1972 to be stale, got %v %v", total, years)
+	}
+	sum := checkCachedSummary(t, db)
+	if len(sum.Yearly[2].TopPlaces) != 1 || sum.Yearly[2].TopPlaces[0].Name != "Work" {
+		t.Errorf("Expected the visit in 1972, got %+v", sum.Yearly[2])
+	}
+}
+
+func TestRefreshSummaries(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := GetTotalSummary(db, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetSummaryofYear(db, 1990, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertItem(db, Result{Title: "Search", Action: "Searched for", Item: "new", Date: "d", UnixTime: 150}); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshSummaries(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	total, years := staleSummaries(t, db)
+	if total || !reflect.DeepEqual(years, map[int]bool{1970: false, 1990: false}) {
+		t.Errorf("Expected a fresh cache, got %v %v", total, years)
+	}
+	checkCachedSummary(t, db)
+
+	// Rebuilding drops summaries of years outside the total
+	if err := RebuildSummaries(db, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	total, years = staleSummaries(t, db)
+	if total || !reflect.DeepEqual(years, map[int]bool{1970: false}) {
+		t.Errorf("Expected a rebuilt cache, got %v %v", total, years)
+	}
+	checkCachedSummary(t, db)
+}
+
+func TestSummaryCacheZones(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	// Both zones are named "X", but start the year at different times
+	east := time.FixedZone("X", 60*60)
+	west := time.FixedZone("X", -60*60)
+	if err := InsertItem(db, Result{Title: "Search", Action: "Searched for", Item: "new year", Date: "d", UnixTime: 31536000 - 30*60}); err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range []*time.Location{east, west, east} {
+		sum, err := GetTotalSummaryWithOptions(context.Background(), db, loc, SummaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first items are just after midnight UTC, and the last just before
+		want := map[int]int{1970: 4, 1971: 1}
+		if loc == west {
+			want = map[int]int{1969: 4, 1970: 1}
+		}
+		got := map[int]int{}
+		for _, year := range sum.Yearly {
+			got[year.Year] = year.Total
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected yearly totals %v in %v, got %v", want, loc, got)
+		}
+	}
+}
+
+func BenchmarkRebuildSummaries(b *testing.B) {
+	db, cleanup := openSummaryBenchDB(b, 15, 2000)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := RebuildSummaries(db, time.UTC); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
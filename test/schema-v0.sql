@@ -0,0 +1,21 @@
+-- A database as written by the original OpenDB, before url/channelurl,
+-- utcoffset, the caption detail tables or plain text storage
+CREATE TABLE "items" (
+	"title"	TEXT,
+	"action"	TEXT,
+	"item"	TEXT,
+	"channel"	TEXT,
+	"date"	TEXT,
+	"unixtime"	INTEGER,
+	PRIMARY KEY("action","unixtime","item")
+);
+CREATE TABLE "locationhistory" (
+	"unixtime"	INTEGER,
+	"latitude"	INTEGER,
+	"longitude"	INTEGER
+);
+INSERT INTO "items" VALUES ("YouTube", "Watched", "Gophers+%26+Goroutines", "Go+Channel", "2019-03-02T10%3A15%3A00", 1551521700);
+INSERT INTO "items" VALUES ("Search", "Searched+for", "sqlite+%22row+values%22", "", "2019-03-03T08%3A00%3A00", 1551600000);
+INSERT INTO "items" VALUES ("Maps", "Viewed", "Caf%C3%A9+near+me", "", "2018-12-31T23%3A59%3A59", 1546300799);
+INSERT INTO "locationhistory" VALUES (1551521700, 377749295, -1224194155);
+INSERT INTO "locationhistory" VALUES (1551600000, 407127753, -740059728);
@@ -0,0 +1,171 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// summaryTop is how many of each kind of item summaries list
+const summaryTop = 10
+
+// GroupBy is what TopN counts items by
+type GroupBy int
+
+const (
+	// GroupByItem counts each item, e.g. a search or a video
+	GroupByItem GroupBy = iota
+	// GroupByChannel counts the channel items came from
+	GroupByChannel
+	// GroupByTitle counts the product items are from, e.g. YouTube
+	GroupByTitle
+	// GroupByAction counts what was done, e.g. "Watched"
+	GroupByAction
+	// GroupByDomain counts the host name of the URL of items, in lower case
+	GroupByDomain
+	// GroupByHour counts the hour of the day, "00" to "23", in the time zone
+	// items were recorded in
+	GroupByHour
+)
+
+// GroupFreq is how often a name was found by TopN, and when it was first and
+// last found
+type GroupFreq struct {
+	Name      string `json:"name"`
+	Count     int    `json:"count"`
+	FirstSeen int64  `json:"firstseen"`
+	LastSeen  int64  `json:"lastseen"`
+}
+
+// urlHost is everything in "url" after the scheme, with a slash appended so
+// it always has one after the host
+const urlHost = `substr("url", instr("url", '://') + 3) || '/'`
+
+// expr returns the SQL for the name g gives an item
+func (g GroupBy) expr() (string, error) {
+	switch g {
+	case GroupByItem:
+		return `"item"`, nil
+	case GroupByChannel:
+		return `"channel"`, nil
+	case GroupByTitle:
+		return `"title"`, nil
+	case GroupByAction:
+		return `"action"`, nil
+	case GroupByDomain:
+		return `CASE WHEN instr("url", '://') > 0 THEN lower(substr(` + urlHost + `, 1, instr(` + urlHost + `, '/') - 1)) ELSE '' END`, nil
+	case GroupByHour:
+		return `strftime('%H', "unixtime" + COALESCE("utcoffset", 0), 'unixepoch')`, nil
+	}
+	return "", fmt.Errorf("Invalid grouping %d", g)
+}
+
+func itemFreqs(freqs []GroupFreq) []ItemFreq {
+	var items []ItemFreq
+	for _, freq := range freqs {
+		items = append(items, ItemFreq{Name: freq.Name, Count: freq.Count})
+	}
+	return items
+}
+
+func channelFreqs(freqs []GroupFreq) []ChannelFreq {
+	var channels []ChannelFreq
+	for _, freq := range freqs {
+		channels = append(channels, ChannelFreq{Name: freq.Name, Count: freq.Count})
+	}
+	return channels
+}
+
+// TopN counts the items matching filter by groupBy, returning the n most
+// frequent non empty names with ties broken alphabetically. An n below 1
+// returns every name.
+func TopN(db *sql.DB, groupBy GroupBy, n int, filter ItemFilter) ([]GroupFreq, error) {
+	return TopNContext(context.Background(), db, groupBy, n, filter)
+}
+
+// TopNContext is TopN, stopped when ctx is done
+func TopNContext(ctx context.Context, db *sql.DB, groupBy GroupBy, n int, filter ItemFilter) ([]GroupFreq, error) {
+	return topN(ctx, db, groupBy, n, filter)
+}
+
+func topN(ctx context.Context, db queryer, groupBy GroupBy, n int, filter ItemFilter) ([]GroupFreq, error) {
+	expr, err := groupBy.expr()
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		n = -1
+	}
+
+	where, args := filter.where()
+	rows, err := db.QueryContext(ctx, `
+	SELECT `+expr+` AS "name", COUNT(*), MIN("unixtime"), MAX("unixtime")
+	FROM "items"`+where+`
+	GROUP BY "name"
+	HAVING "name" != ''
+	ORDER BY COUNT(*) DESC, "name" ASC
+	LIMIT ?;
+	`, append(args, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var freqs []GroupFreq
+	for rows.Next() {
+		var freq GroupFreq
+		if err := rows.Scan(&freq.Name, &freq.Count, &freq.FirstSeen, &freq.LastSeen); err != nil {
+			return nil, err
+		}
+		freqs = append(freqs, freq)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return freqs, nil
+}
+
+// topByYear is topN for each year at once, keeping the n most frequent names
+// of each
+func topByYear(ctx context.Context, db queryer, groupBy GroupBy, n int, ranges []yearRange) (map[int][]GroupFreq, error) {
+	top := map[int][]GroupFreq{}
+	if len(ranges) == 0 {
+		return top, nil
+	}
+	expr, err := groupBy.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	freqs, err := db.QueryContext(ctx, yearsTable(ranges)+`
+	SELECT "year", "name", "count", "first", "last" FROM (
+		SELECT y."year", `+expr+` AS "name", COUNT(*) AS "count", MIN("unixtime") AS "first", MAX("unixtime") AS "last",
+			ROW_NUMBER() OVER (PARTITION BY y."year" ORDER BY COUNT(*) DESC, `+expr+` ASC) AS "rank"
+		FROM "years" AS y JOIN "items" AS i ON i."unixtime" BETWEEN y."begin" AND y."end"
+		GROUP BY y."year", "name"
+		HAVING "name" != ''
+	) WHERE "rank" <= ?
+	ORDER BY "year", "rank";
+	`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer freqs.Close()
+
+	for freqs.Next() {
+		var year int
+		var freq GroupFreq
+		if err := freqs.Scan(&year, &freq.Name, &freq.Count, &freq.FirstSeen, &freq.LastSeen); err != nil {
+			return nil, err
+		}
+		top[year] = append(top[year], freq)
+	}
+	// Check for errors from iterating over rows.
+	if err := freqs.Err(); err != nil {
+		return nil, err
+	}
+	return top, nil
+}
@@ -0,0 +1,61 @@
+package ParseTakeout
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopN(t *testing.T) {
+	db, cleanup := openDeleteTestDB(t)
+	defer cleanup()
+
+	for _, res := range []Result{
+		{Title: "YouTube", Action: "Watched", Item: "video 1", Date: "d", UnixTime: 5 * 3600, UTCOffset: 3600, URL: "https://www.YouTube.com/watch?v=1"},
+		{Title: "YouTube", Action: "Watched", Item: "video 2", Date: "d", UnixTime: 6 * 3600, URL: "https://www.youtube.com/watch?v=2"},
+		{Title: "Search", Action: "Visited", Item: "example", Date: "d", UnixTime: 7 * 3600, URL: "http://example.com"},
+	} {
+		if err := InsertItem(db, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		groupBy GroupBy
+		n       int
+		filter  ItemFilter
+		want    []GroupFreq
+	}{
+		{GroupByTitle, 0, ItemFilter{}, []GroupFreq{
+			{"YouTube", 4, 200, 6 * 3600},
+			{"Search", 3, 100, 7 * 3600},
+		}},
+		{GroupByAction, 1, ItemFilter{Title: "YouTube"}, []GroupFreq{
+			{"Watched", 4, 200, 6 * 3600},
+		}},
+		{GroupByItem, 2, ItemFilter{Begin: 200, End: 301}, []GroupFreq{
+			{"cats", 1, 300, 300},
+			{"golang talk", 1, 200, 200},
+		}},
+		{GroupByDomain, 0, ItemFilter{}, []GroupFreq{
+			{"www.youtube.com", 2, 5 * 3600, 6 * 3600},
+			{"example.com", 1, 7 * 3600, 7 * 3600},
+		}},
+		{GroupByHour, 0, ItemFilter{Search: "video"}, []GroupFreq{
+			{"06", 2, 5 * 3600, 6 * 3600},
+		}},
+		{GroupByChannel, 0, ItemFilter{}, nil},
+	}
+	for _, test := range tests {
+		got, err := TopN(db, test.groupBy, test.n, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("TopN(%d, %d, %+v) = %+v, expected %+v", test.groupBy, test.n, test.filter, got, test.want)
+		}
+	}
+
+	if _, err := TopN(db, GroupBy(-1), 0, ItemFilter{}); err == nil {
+		t.Error("Expected an invalid grouping to fail")
+	}
+}
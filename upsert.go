@@ -0,0 +1,435 @@
+package ParseTakeout
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Outcome is what upserting a record did to the database
+type Outcome int
+
+const (
+	// OutcomeNew records were not in the database
+	OutcomeNew Outcome = iota
+	// OutcomeDuplicate records were already stored with the same content
+	OutcomeDuplicate
+	// OutcomeUpdated records replaced a stored one with the same key but
+	// different content
+	OutcomeUpdated
+)
+
+// ImportSummary counts the outcomes of an import. Skipped records were
+// invalid.
+type ImportSummary struct {
+	New       int `json:"new"`
+	Duplicate int `json:"duplicate"`
+	Updated   int `json:"updated"`
+	Skipped   int `json:"skipped"`
+}
+
+func (s ImportSummary) String() string {
+	return fmt.Sprintf("new %d, duplicate %d, updated %d, skipped %d", s.New, s.Duplicate, s.Updated, s.Skipped)
+}
+
+// Count adds one outcome to the summary
+func (s *ImportSummary) Count(o Outcome) {
+	switch o {
+	case OutcomeNew:
+		s.New++
+	case OutcomeDuplicate:
+		s.Duplicate++
+	case OutcomeUpdated:
+		s.Updated++
+	}
+}
+
+// Add adds the counts of o to the summary
+func (s *ImportSummary) Add(o ImportSummary) {
+	s.New += o.New
+	s.Duplicate += o.Duplicate
+	s.Updated += o.Updated
+	s.Skipped += o.Skipped
+}
+
+func newHash() hash.Hash {
+	return sha256.New()
+}
+
+func sumHash(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash is a stable digest of everything stored for the item, so the same
+// activity from two Takeouts hashes the same
+func (r Result) Hash() string {
+	h := newHash()
+	fmt.Fprintf(h, "%q %q %q %q %q %q %q %d %d\n", r.Title, r.Action, r.Item, r.URL, r.Channel, r.ChannelURL, r.Date, r.UnixTime, r.UTCOffset)
+	for _, product := range r.Products {
+		fmt.Fprintf(h, "p %q\n", product)
+	}
+	for _, detail := range r.Details {
+		fmt.Fprintf(h, "d %q\n", detail)
+	}
+	for _, loc := range r.Locations {
+		fmt.Fprintf(h, "l %q %q %v %v\n", loc.Name, loc.URL, loc.Latitude, loc.Longitude)
+	}
+	return sumHash(h)
+}
+
+func (l Location) Hash() string {
+	h := newHash()
+	fmt.Fprintf(h, "%d %d %d %d %d %d %d %d %d %q %d\n", l.Unixtime, l.Latitude, l.Longitude, l.UnixTimeMs, l.Accuracy, l.Altitude, l.VerticalAccuracy, l.Velocity, l.Heading, l.Source, l.DeviceTag)
+	for _, a := range l.Activities {
+		fmt.Fprintf(h, "a %d %q %d\n", a.Unixtime, a.Type, a.Confidence)
+	}
+	return sumHash(h)
+}
+
+func (v PlaceVisit) Hash() string {
+	h := newHash()
+	fmt.Fprintf(h, "%d %d %d %d %q %q %q %q %d\n", v.StartTime, v.EndTime, v.Latitude, v.Longitude, v.PlaceID, v.Name, v.Address, v.Confidence, v.VisitConfidence)
+	return sumHash(h)
+}
+
+func (s ActivitySegment) Hash() string {
+	h := newHash()
+	fmt.Fprintf(h, "%d %d %d %d %d %d %d %q %q\n", s.StartTime, s.EndTime, s.StartLatitude, s.StartLongitude, s.EndLatitude, s.EndLongitude, s.Distance, s.ActivityType, s.Confidence)
+	for _, w := range s.Waypoints {
+		fmt.Fprintf(h, "w %d %d\n", w.Latitude, w.Longitude)
+	}
+	return sumHash(h)
+}
+
+// outcome compares the hash stored under a record's key with its new hash
+func (w *Writer) outcome(newHash string, query string, args ...interface{}) (Outcome, error) {
+	var stored sql.NullString
+	err := w.scan(query, args, &stored)
+	if err == sql.ErrNoRows {
+		return OutcomeNew, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if stored.Valid && stored.String == newHash {
+		return OutcomeDuplicate, nil
+	}
+	return OutcomeUpdated, nil
+}
+
+// UpsertItem inserts res, or replaces the item stored with the same action,
+// time and item if its content differs. New and updated rows belong to the
+// current import, which keeps what it replaced so rolling it back restores it.
+func (w *Writer) UpsertItem(res Result) (Outcome, error) {
+	h := res.Hash()
+	o, err := w.outcome(h, `
+	SELECT "hash" FROM "items"
+	WHERE "action" = ? AND "unixtime" = ? AND "item" = ?;
+	`, res.Action, res.UnixTime, res.Item)
+	if err != nil || o == OutcomeDuplicate {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		err := w.saveReplaced(kindItem, res.Action, res.UnixTime, res.Item)
+		if err != nil {
+			return o, err
+		}
+	}
+
+	// The children go in first so the search index trigger on "items" picks
+	// up the details with the item, instead of reindexing it per detail
+	if o == OutcomeUpdated {
+		for _, table := range itemDetailTables {
+			_, err := w.Exec(fmt.Sprintf(`
+			DELETE FROM "%s"
+			WHERE "action" = ? AND "unixtime" = ? AND "item" = ?;
+			`, table), res.Action, res.UnixTime, res.Item)
+			if err != nil {
+				return o, err
+			}
+		}
+	}
+	err = insertItemDetails(w.ctx, w, res)
+	if err != nil {
+		return o, err
+	}
+	_, err = w.Exec(`
+	INSERT INTO "items" ("title", "action", "item", "channel", "date", "unixtime", "url", "channelurl", "utcoffset", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT ("action", "unixtime", "item") DO UPDATE SET
+		"title" = excluded."title",
+		"channel" = excluded."channel",
+		"date" = excluded."date",
+		"url" = excluded."url",
+		"channelurl" = excluded."channelurl",
+		"utcoffset" = excluded."utcoffset",
+		"hash" = excluded."hash",
+		"importid" = excluded."importid";
+	`, res.Title, res.Action, res.Item, res.Channel, res.Date, res.UnixTime, res.URL, res.ChannelURL, res.UTCOffset, h, w.importID)
+	if err != nil {
+		return o, err
+	}
+	return o, w.added()
+}
+
+// UpsertLocation inserts loc, or replaces the point stored with the same time
+// and coordinates if its content differs
+func (w *Writer) UpsertLocation(loc Location) (Outcome, error) {
+	h := loc.Hash()
+	o, err := w.outcome(h, `
+	SELECT "hash" FROM "locationhistory"
+	WHERE "unixtime" = ? AND "latitude" = ? AND "longitude" = ?;
+	`, loc.Unixtime, loc.Latitude, loc.Longitude)
+	if err != nil || o == OutcomeDuplicate {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		err := w.saveReplaced(kindLocation, loc.Unixtime, loc.Latitude, loc.Longitude)
+		if err != nil {
+			return o, err
+		}
+	}
+
+	_, err = w.Exec(`
+	INSERT INTO "locationhistory" ("unixtime", "latitude", "longitude", "unixtimems", "accuracy", "altitude", "verticalaccuracy", "velocity", "heading", "source", "devicetag", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT ("unixtime", "latitude", "longitude") DO UPDATE SET
+		"unixtimems" = excluded."unixtimems",
+		"accuracy" = excluded."accuracy",
+		"altitude" = excluded."altitude",
+		"verticalaccuracy" = excluded."verticalaccuracy",
+		"velocity" = excluded."velocity",
+		"heading" = excluded."heading",
+		"source" = excluded."source",
+		"devicetag" = excluded."devicetag",
+		"hash" = excluded."hash",
+		"importid" = excluded."importid";
+	`, loc.Unixtime, loc.Latitude, loc.Longitude, loc.UnixTimeMs, loc.Accuracy, loc.Altitude, loc.VerticalAccuracy, loc.Velocity, loc.Heading, loc.Source, loc.DeviceTag, h, w.importID)
+	if err != nil {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		_, err := w.Exec(`
+		DELETE FROM "locationactivity"
+		WHERE "locationtime" = ? AND "locationlatitude" = ? AND "locationlongitude" = ?;
+		`, loc.Unixtime, loc.Latitude, loc.Longitude)
+		if err != nil {
+			return o, err
+		}
+	}
+	err = insertLocationActivity(w.ctx, w, loc)
+	if err != nil {
+		return o, err
+	}
+	return o, w.added()
+}
+
+// UpsertPlaceVisit inserts visit, or replaces the visit stored with the same
+// start time if its content differs
+func (w *Writer) UpsertPlaceVisit(visit PlaceVisit) (Outcome, error) {
+	h := visit.Hash()
+	o, err := w.outcome(h, `
+	SELECT "hash" FROM "placevisits" WHERE "starttime" = ?;
+	`, visit.StartTime)
+	if err != nil || o == OutcomeDuplicate {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		err := w.saveReplaced(kindPlaceVisit, visit.StartTime)
+		if err != nil {
+			return o, err
+		}
+	}
+
+	_, err = w.Exec(`
+	INSERT INTO "placevisits" ("starttime", "endtime", "latitude", "longitude", "placeid", "name", "address", "confidence", "visitconfidence", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT ("starttime") DO UPDATE SET
+		"endtime" = excluded."endtime",
+		"latitude" = excluded."latitude",
+		"longitude" = excluded."longitude",
+		"placeid" = excluded."placeid",
+		"name" = excluded."name",
+		"address" = excluded."address",
+		"confidence" = excluded."confidence",
+		"visitconfidence" = excluded."visitconfidence",
+		"hash" = excluded."hash",
+		"importid" = excluded."importid";
+	`, visit.StartTime, visit.EndTime, visit.Latitude, visit.Longitude, visit.PlaceID, visit.Name, visit.Address, visit.Confidence, visit.VisitConfidence, h, w.importID)
+	if err != nil {
+		return o, err
+	}
+	return o, w.added()
+}
+
+// UpsertActivitySegment inserts segment, or replaces the segment stored with
+// the same start time if its content differs
+func (w *Writer) UpsertActivitySegment(segment ActivitySegment) (Outcome, error) {
+	h := segment.Hash()
+	o, err := w.outcome(h, `
+	SELECT "hash" FROM "activitysegments" WHERE "starttime" = ?;
+	`, segment.StartTime)
+	if err != nil || o == OutcomeDuplicate {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		err := w.saveReplaced(kindActivitySegment, segment.StartTime)
+		if err != nil {
+			return o, err
+		}
+	}
+
+	_, err = w.Exec(`
+	INSERT INTO "activitysegments" ("starttime", "endtime", "startlatitude", "startlongitude", "endlatitude", "endlongitude", "distance", "activitytype", "confidence", "hash", "importid")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT ("starttime") DO UPDATE SET
+		"endtime" = excluded."endtime",
+		"startlatitude" = excluded."startlatitude",
+		"startlongitude" = excluded."startlongitude",
+		"endlatitude" = excluded."endlatitude",
+		"endlongitude" = excluded."endlongitude",
+		"distance" = excluded."distance",
+		"activitytype" = excluded."activitytype",
+		"confidence" = excluded."confidence",
+		"hash" = excluded."hash",
+		"importid" = excluded."importid";
+	`, segment.StartTime, segment.EndTime, segment.StartLatitude, segment.StartLongitude, segment.EndLatitude, segment.EndLongitude, segment.Distance, segment.ActivityType, segment.Confidence, h, w.importID)
+	if err != nil {
+		return o, err
+	}
+	if o == OutcomeUpdated {
+		_, err := w.Exec(`
+		DELETE FROM "activitywaypoints" WHERE "starttime" = ?;
+		`, segment.StartTime)
+		if err != nil {
+			return o, err
+		}
+	}
+	err = insertWaypoints(w.ctx, w, segment)
+	if err != nil {
+		return o, err
+	}
+	return o, w.added()
+}
+
+// backfillBatch is how many rows without a hash backfillHashes loads at once
+const backfillBatch = 1000
+
+// backfillHashes fills in the hash of rows written before hashes were
+// stored, so importing them again counts them as duplicates
+func backfillHashes(ctx context.Context, db *sql.DB) error {
+	err := backfillTable(ctx, db, "items", func(where string, args ...interface{}) ([]string, error) {
+		results, err := queryItems(ctx, db, where, args...)
+		hashes := make([]string, len(results))
+		for i, res := range results {
+			hashes[i] = res.Hash()
+		}
+		return hashes, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = backfillTable(ctx, db, "locationhistory", func(where string, args ...interface{}) ([]string, error) {
+		locations, err := queryLocations(ctx, db, where, args...)
+		hashes := make([]string, len(locations))
+		for i, loc := range locations {
+			hashes[i] = loc.Hash()
+		}
+		return hashes, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = backfillTable(ctx, db, "placevisits", func(where string, args ...interface{}) ([]string, error) {
+		visits, err := queryPlaceVisits(ctx, db, where, args...)
+		hashes := make([]string, len(visits))
+		for i, visit := range visits {
+			hashes[i] = visit.Hash()
+		}
+		return hashes, err
+	})
+	if err != nil {
+		return err
+	}
+
+	return backfillTable(ctx, db, "activitysegments", func(where string, args ...interface{}) ([]string, error) {
+		segments, err := queryActivitySegments(ctx, db, where, args...)
+		hashes := make([]string, len(segments))
+		for i, segment := range segments {
+			hashes[i] = segment.Hash()
+		}
+		return hashes, err
+	})
+}
+
+// backfillTable hashes the rows of table without a hash a batch at a time.
+// Rows are read and updated in rowid order, not by their key, which legacy
+// rows with NULL columns may not match. hash returns the hashes of the rows
+// selected by where, in order.
+func backfillTable(ctx context.Context, db *sql.DB, table string, hash func(where string, args ...interface{}) ([]string, error)) error {
+	where := `WHERE "hash" IS NULL AND "rowid" > ? ORDER BY "rowid" LIMIT ?`
+	var after int64
+	for {
+		rowids, err := queryRowids(ctx, db, table, where, after, backfillBatch)
+		if err != nil {
+			return err
+		}
+		if len(rowids) == 0 {
+			return nil
+		}
+		hashes, err := hash(where, after, backfillBatch)
+		if err != nil {
+			return err
+		}
+		if len(hashes) != len(rowids) {
+			return fmt.Errorf("Expected %d rows of %s to hash, got %d", len(rowids), table, len(hashes))
+		}
+
+		w := NewWriterContext(ctx, db, 0)
+		for i, rowid := range rowids {
+			_, err := w.Exec(`UPDATE "`+table+`" SET "hash" = ? WHERE "rowid" = ?;`, hashes[i], rowid)
+			if err != nil {
+				w.Rollback()
+				return err
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		if len(rowids) < backfillBatch {
+			return nil
+		}
+		after = rowids[len(rowids)-1]
+	}
+}
+
+func queryRowids(ctx context.Context, db *sql.DB, table, where string, args ...interface{}) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT "rowid" FROM "`+table+`" `+where+`;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rowids []int64
+	for rows.Next() {
+		var rowid int64
+		if err := rows.Scan(&rowid); err != nil {
+			return nil, err
+		}
+		rowids = append(rowids, rowid)
+	}
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rowids, nil
+}
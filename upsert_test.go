@@ -0,0 +1,218 @@
+package ParseTakeout
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpsert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "upsert.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	res := Result{
+		Title:    "YouTube",
+		Action:   "Watched",
+		Item:     "A Video",
+		Date:     "2019-12-31T23:59:59",
+		UnixTime: 1577836799,
+		Products: []string{"YouTube"},
+	}
+	loc := Location{Unixtime: 1577836799, Latitude: 1, Longitude: 2, Accuracy: 10}
+
+	w := NewWriter(db, 0)
+	var summary ImportSummary
+	upsert := func() {
+		o, err := w.UpsertItem(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary.Count(o)
+		o, err = w.UpsertLocation(loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary.Count(o)
+	}
+
+	upsert()
+	upsert()
+	res.Channel = "A Channel"
+	res.Products = []string{"YouTube", "YouTube Music"}
+	loc.Accuracy = 5
+	loc.Activities = []LocationActivity{{Unixtime: 1577836790, Type: "STILL", Confidence: 100}}
+	upsert()
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImportSummary{New: 2, Duplicate: 2, Updated: 2}
+	if summary != expected {
+		t.Fatalf("Expected %v, got %v", expected, summary)
+	}
+
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Channel != "A Channel" || len(results[0].Products) != 2 {
+		t.Fatalf("Expected the updated item, got %v", results)
+	}
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || locations[0].Accuracy != 5 || len(locations[0].Activities) != 1 {
+		t.Fatalf("Expected the updated location, got %v", locations)
+	}
+}
+
+func TestBackfillHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	schema, err := ioutil.ReadFile(testHome + "schema-v0.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "v0.db")
+	v0, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v0.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Points imported twice before there was a key
+	_, err = v0.Exec(`INSERT INTO "locationhistory" SELECT * FROM "locationhistory";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A point without coordinates, which no key matches
+	_, err = v0.Exec(`INSERT INTO "locationhistory" VALUES (1551600001, NULL, NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0.Close()
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"items", "locationhistory"} {
+		var missing int
+		err = db.QueryRow(`SELECT COUNT(*) FROM "` + table + `" WHERE "hash" IS NULL;`).Scan(&missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if missing != 0 {
+			t.Fatalf("Expected every row of %s hashed, %d are not", table, missing)
+		}
+	}
+
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 3 {
+		t.Fatalf("Expected the duplicate points dropped, got %d", len(locations))
+	}
+
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(db, 0)
+	for _, res := range results {
+		o, err := w.UpsertItem(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o != OutcomeDuplicate {
+			t.Fatalf("Expected %v to be a duplicate, got %v", res, o)
+		}
+	}
+	for _, loc := range locations {
+		// The point without coordinates reads back as 0,0, which is another key
+		if loc.Latitude == 0 {
+			continue
+		}
+		o, err := w.UpsertLocation(loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o != OutcomeDuplicate {
+			t.Fatalf("Expected %v to be a duplicate, got %v", loc, o)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertLocationSharedTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "upsert.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Two devices report a point in the same second
+	phone := Location{Unixtime: 1577836799, Latitude: 1, Longitude: 2, DeviceTag: 1,
+		Activities: []LocationActivity{{Unixtime: 1577836790, Type: "WALKING", Confidence: 80}}}
+	watch := Location{Unixtime: 1577836799, Latitude: 3, Longitude: 4, DeviceTag: 2,
+		Activities: []LocationActivity{{Unixtime: 1577836790, Type: "STILL", Confidence: 70}}}
+
+	w := NewWriter(db, 0)
+	for _, loc := range []Location{phone, watch} {
+		if _, err := w.UpsertLocation(loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watch.Accuracy = 5
+	if o, err := w.UpsertLocation(watch); err != nil || o != OutcomeUpdated {
+		t.Fatalf("Expected the watch point to be updated, got %v %v", o, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[int64][]string{}
+	for _, loc := range locations {
+		for _, a := range loc.Activities {
+			types[loc.DeviceTag] = append(types[loc.DeviceTag], a.Type)
+		}
+	}
+	if len(types[1]) != 1 || types[1][0] != "WALKING" || len(types[2]) != 1 || types[2][0] != "STILL" {
+		t.Errorf("Expected each point to keep its own activity, got %v", types)
+	}
+}
@@ -0,0 +1,201 @@
+package ParseTakeout
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DefaultBatchSize is how many records a Writer commits at once when given a
+// batch size below 1
+const DefaultBatchSize = 10000
+
+// execer is satisfied by *sql.DB, *sql.Tx and *Writer
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is satisfied by *sql.DB, *sql.Tx and *Writer
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// beginner is satisfied by *sql.DB and *sql.Conn
+type beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Writer inserts records in batched transactions, preparing each statement
+// once per batch instead of running an autocommit Exec per record. Records are
+// only visible to other connections once their batch is flushed, so Close or
+// Flush must be called when done.
+type Writer struct {
+	ctx       context.Context
+	db        *sql.DB
+	batchSize int
+	tx        *sql.Tx
+	stmts     map[string]*sql.Stmt
+	pending   int
+	// importID is the import rows written now belong to, NULL outside one
+	importID sql.NullInt64
+}
+
+func NewWriter(db *sql.DB, batchSize int) *Writer {
+	return NewWriterContext(context.Background(), db, batchSize)
+}
+
+// NewWriterContext returns a Writer whose batches run under ctx. Once ctx is
+// done the current batch is rolled back and every call fails with its error.
+func NewWriterContext(ctx context.Context, db *sql.DB, batchSize int) *Writer {
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	return &Writer{
+		ctx:       ctx,
+		db:        db,
+		batchSize: batchSize,
+	}
+}
+
+// stmt returns query prepared in the current batch, beginning one if needed
+func (w *Writer) stmt(query string) (*sql.Stmt, error) {
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if w.tx == nil {
+		tx, err := w.db.BeginTx(w.ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.tx = tx
+		w.stmts = map[string]*sql.Stmt{}
+	}
+
+	stmt, ok := w.stmts[query]
+	if !ok {
+		var err error
+		stmt, err = w.tx.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		w.stmts[query] = stmt
+	}
+	return stmt, nil
+}
+
+// Exec runs query in the current batch
+func (w *Writer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return w.ExecContext(w.ctx, query, args...)
+}
+
+// ExecContext runs query in the current batch under ctx, which can only
+// narrow the context of the Writer as the batch runs under both
+func (w *Writer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := w.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// QueryContext runs query in the current batch under ctx, so records added but
+// not yet flushed are seen
+func (w *Writer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := w.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// scan reads a single row in the current batch, so records added but not yet
+// flushed are seen
+func (w *Writer) scan(query string, args []interface{}, dest ...interface{}) error {
+	stmt, err := w.stmt(query)
+	if err != nil {
+		return err
+	}
+	return stmt.QueryRowContext(w.ctx, args...).Scan(dest...)
+}
+
+// Pending is how many records are waiting for the next flush
+func (w *Writer) Pending() int {
+	return w.pending
+}
+
+// added counts a record towards the batch, flushing once it is full
+func (w *Writer) added() error {
+	w.pending++
+	if w.pending < w.batchSize {
+		return nil
+	}
+	return w.Flush()
+}
+
+func (w *Writer) InsertItem(res Result) error {
+	err := insertItem(w.ctx, w, res, w.importID)
+	if err != nil {
+		return err
+	}
+	return w.added()
+}
+
+func (w *Writer) InsertLocation(loc Location) error {
+	err := insertLocation(w.ctx, w, loc, w.importID)
+	if err != nil {
+		return err
+	}
+	return w.added()
+}
+
+func (w *Writer) InsertPlaceVisit(visit PlaceVisit) error {
+	err := insertPlaceVisit(w.ctx, w, visit, w.importID)
+	if err != nil {
+		return err
+	}
+	return w.added()
+}
+
+func (w *Writer) InsertActivitySegment(segment ActivitySegment) error {
+	err := insertActivitySegment(w.ctx, w, segment, w.importID)
+	if err != nil {
+		return err
+	}
+	return w.added()
+}
+
+// Flush commits the pending records
+func (w *Writer) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	tx := w.tx
+	w.closeStmts()
+	w.pending = 0
+	return tx.Commit()
+}
+
+// Rollback discards the records added since the last flush
+func (w *Writer) Rollback() error {
+	if w.tx == nil {
+		return nil
+	}
+	tx := w.tx
+	w.closeStmts()
+	w.pending = 0
+	return tx.Rollback()
+}
+
+// Close flushes the pending records
+func (w *Writer) Close() error {
+	return w.Flush()
+}
+
+func (w *Writer) closeStmts() {
+	for _, stmt := range w.stmts {
+		stmt.Close()
+	}
+	w.stmts = nil
+	w.tx = nil
+}
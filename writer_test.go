@@ -0,0 +1,163 @@
+package ParseTakeout
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writerTestItem(i int) Result {
+	return Result{
+		Title:    "Search",
+		Action:   "Searched for",
+		Item:     "query",
+		Date:     "2019-01-01T00:00:00",
+		UnixTime: 1546300800 + int64(i),
+		Products: []string{"Search"},
+	}
+}
+
+func TestWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenDB(filepath.Join(dir, "writer.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := NewWriter(db, 3)
+	for i := 0; i < 7; i++ {
+		err := w.InsertItem(writerTestItem(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Pending() != 1 {
+		t.Fatalf("Expected 1 pending item, got %d", w.Pending())
+	}
+
+	// A duplicate fails without spoiling the batch
+	err = w.InsertItem(writerTestItem(0))
+	if err == nil {
+		t.Fatal("Expected an error inserting a duplicate")
+	}
+	err = w.InsertLocation(Location{Unixtime: 1546300800, Latitude: 1, Longitude: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rollback only discards what was not flushed
+	err = w.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := GetAllItems(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Fatalf("Expected 6 flushed items, got %d", len(results))
+	}
+	locations, err := GetAllLocations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 0 {
+		t.Fatalf("Expected the location to be rolled back, got %v", locations)
+	}
+
+	// The writer can be used again after a rollback
+	err = w.InsertItem(writerTestItem(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = GetItemsByProduct(db, "Search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 7 {
+		t.Fatalf("Expected 7 items with their products, got %d", len(results))
+	}
+}
+
+func openWriterBenchDB(b *testing.B) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "takeout")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := OpenDB(filepath.Join(dir, "bench.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// benchmarkUpsertItems times upserting n items, each with a product and a
+// detail, into a new database as one import, reporting the time per item
+func benchmarkUpsertItems(b *testing.B, n int) {
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, cleanup := openWriterBenchDB(b)
+		b.StartTimer()
+		start := time.Now()
+
+		w := NewWriter(db, 0)
+		if _, err := w.BeginImport("", "bench.html", "bench"); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < n; j++ {
+			res := Result{
+				Title:    "Search",
+				Action:   "Searched for",
+				Item:     fmt.Sprint("query ", j),
+				Date:     "d",
+				UnixTime: 1546300800 + int64(j),
+				Products: []string{"Search"},
+				Details:  []string{fmt.Sprint("detail ", j%100)},
+			}
+			if _, err := w.UpsertItem(res); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := w.FinishImport("", ImportSummary{}); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+
+		elapsed += time.Since(start)
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*n), "ns/item")
+}
+
+// BenchmarkUpsertItems imports up to the 500k items of a large My Activity
+// export, each with a product and a detail
+func BenchmarkUpsertItems(b *testing.B) {
+	for _, n := range []int{50000, 500000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkUpsertItems(b, n)
+		})
+	}
+}